@@ -1,12 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/nuvo/skbn/pkg/skbn"
+	"github.com/nuvo/skbn/pkg/utils"
 
 	"github.com/spf13/cobra"
 )
@@ -29,6 +36,10 @@ func NewRootCmd(args []string) *cobra.Command {
 	out := cmd.OutOrStdout()
 
 	cmd.AddCommand(NewCpCmd(out))
+	cmd.AddCommand(NewMvCmd(out))
+	cmd.AddCommand(NewLsCmd(out))
+	cmd.AddCommand(NewRmCmd(out))
+	cmd.AddCommand(NewCatCmd(out))
 	cmd.AddCommand(NewVersionCmd(out))
 
 	return cmd
@@ -42,6 +53,39 @@ type cpCmd struct {
 	s3partSize       int64
 	s3maxUploadParts int
 	verbose          bool
+	journal          string
+	resume           bool
+	retries          int
+	retryBackoff     time.Duration
+	retryMaxBackoff  time.Duration
+	retryMaxElapsed  time.Duration
+	fanOut           bool
+	kubeconfig       string
+	context          string
+	srcContext       string
+	dstContext       string
+	as               string
+	asGroups         []string
+	debugContainer   bool
+	debugImage       string
+	execTransport    string
+	helperImage      string
+	helperAffinity   map[string]string
+	helperTolerate   []string
+	snapshot         bool
+	snapshotClass    string
+	preHook          string
+	postHook         string
+	hookTarget       string
+	preserve         bool
+	symlinks         string
+	emptyDirs        bool
+	noMultiplex      bool
+	noServerCopy     bool
+	move             bool
+	verify           string
+	manifest         string
+	report           string
 
 	out io.Writer
 }
@@ -54,28 +98,441 @@ func NewCpCmd(out io.Writer) *cobra.Command {
 		Use:   "cp",
 		Short: "Copy files or directories Kubernetes and Cloud storage",
 		Long:  ``,
-		Run: func(cmd *cobra.Command, args []string) {
-			if err := skbn.Copy(c.src, c.dst, c.parallel, c.bufferSize, c.s3partSize, c.s3maxUploadParts, c.verbose); err != nil {
+	}
+	c.setup(cmd)
+
+	return cmd
+}
+
+// NewMvCmd represents the move command
+func NewMvCmd(out io.Writer) *cobra.Command {
+	c := &cpCmd{out: out, move: true}
+
+	cmd := &cobra.Command{
+		Use:   "mv",
+		Short: "Move files or directories Kubernetes and Cloud storage, removing each source file once its copy is verified",
+		Long:  ``,
+	}
+	c.setup(cmd)
+	cmd.Flags().StringVar(&c.verify, "verify", skbn.VerifySize, "how to verify a copied file before its source is removed: size, or checksum (reads the file back from the destination)")
+
+	return cmd
+}
+
+// setup sets the run function and the flags of a copy (or move) command
+func (c *cpCmd) setup(cmd *cobra.Command) {
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		if c.retries < 1 {
+			log.Fatal("--retries must be at least 1, use 1 to disable retries")
+		}
+		helperPod, err := c.helperPodOptions()
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts := skbn.CopyOptions{
+			Parallel:         c.parallel,
+			BufferSize:       c.bufferSize,
+			S3PartSize:       c.s3partSize,
+			S3MaxUploadParts: c.s3maxUploadParts,
+			Verbose:          c.verbose,
+			JournalPath:      c.journal,
+			Resume:           c.resume,
+			Retry: utils.RetryPolicy{
+				MaxAttempts:    c.retries,
+				InitialBackoff: c.retryBackoff,
+				MaxBackoff:     c.retryMaxBackoff,
+				MaxElapsedTime: c.retryMaxElapsed,
+			},
+			FanOut:       c.fanOut,
+			PreHook:      c.preHook,
+			PostHook:     c.postHook,
+			HookTarget:   c.hookTarget,
+			Preserve:     c.preserve,
+			Symlinks:     c.symlinks,
+			EmptyDirs:    c.emptyDirs,
+			NoMultiplex:  c.noMultiplex,
+			NoServerCopy: c.noServerCopy,
+			SrcK8s:       c.k8sClientOptions(c.srcContext, helperPod),
+			DstK8s:       c.k8sClientOptions(c.dstContext, helperPod),
+		}
+		if c.move {
+			opts.Verify = c.verify
+			opts.Move = true
+		}
+		if c.manifest != "" {
+			if c.src != "" || c.dst != "" {
+				log.Fatal("--src and --dst can not be set with --manifest")
+			}
+			if err := c.copyManifest(cmd, opts); err != nil {
 				log.Fatal(err)
 			}
-		},
+			return
+		}
+		if c.report != "" {
+			log.Fatal("--report requires --manifest")
+		}
+		if c.src == "" || c.dst == "" {
+			log.Fatal("--src and --dst are required, unless --manifest is set")
+		}
+		run := skbn.CopyWithOptions
+		if c.move {
+			run = skbn.Move
+		}
+		if err := run(c.src, c.dst, opts); err != nil {
+			log.Fatal(err)
+		}
 	}
 	f := cmd.Flags()
 
-	f.StringVar(&c.src, "src", "", "path to copy from. Example: k8s://<namespace>/<podName>/<containerName>/path/to/copyfrom")
-	f.StringVar(&c.dst, "dst", "", "path to copy to. Example: s3://<bucketName>/path/to/copyto")
-	f.IntVarP(&c.parallel, "parallel", "p", 1, "number of files to copy in parallel. set this flag to 0 for full parallelism")
+	f.StringVar(&c.src, "src", "", "path to copy from. Example: k8s://[<context>@]<namespace>/<podName>/<containerName>/path/to/copyfrom or pvc://[<context>@]<namespace>/<claimName>/path/to/copyfrom. - to copy a single file from stdin")
+	f.StringVar(&c.dst, "dst", "", "path to copy to. Example: s3://<bucketName>/path/to/copyto. - to copy a single file to stdout")
+	f.IntVarP(&c.parallel, "parallel", "p", 1, "number of files to copy in parallel (across all the transfers of a manifest). set this flag to 0 for full parallelism")
+	f.StringVar(&c.manifest, "manifest", "", "path to a YAML file listing transfers (src and dst pairs, with per-transfer options) to run together, instead of --src and --dst")
+	f.StringVar(&c.report, "report", "", "path to a JSON file to write the report of the transfers of a manifest to. Requires --manifest")
 	f.Float64VarP(&c.bufferSize, "buffer-size", "b", 6.75, "in memory buffer size (MB) to use for files copy (buffer per file)")
-	f.Int64VarP(&c.s3partSize, "s3-part-size", "s", 128*1024*1024, "size of each part in bytes for multipart upload to S3. Default is 128MB. Consider that the default MaxUploadParts is 10000 so max file size with default s3 settings is 1.28TB.")
+	f.Int64VarP(&c.s3partSize, "s3-part-size", "s", 0, "size of each part in bytes for multipart upload to S3. Default (0) calculates the part size from the file size, with a minimum of 128MB, or grows it during the upload when the size is unknown.")
 	f.IntVarP(&c.s3maxUploadParts, "s3-max-upload-parts", "m", 10000, "maximum number of parts for multipart upload to S3. Default is 10000.")
 	f.BoolVarP(&c.verbose, "verbose", "v", false, "verbose output")
+	f.StringVar(&c.journal, "journal", "", "path to a local file to record the progress of the copy in")
+	f.BoolVar(&c.resume, "resume", false, "resume a copy recorded in the journal, skipping files already copied and continuing partial uploads")
+	f.IntVar(&c.retries, "retries", 3, "maximum number of attempts for each operation, including the first one. 1 disables retries")
+	f.DurationVar(&c.retryBackoff, "retry-backoff", 1*time.Second, "backoff before the first retry, doubled for each following retry")
+	f.DurationVar(&c.retryMaxBackoff, "retry-max-backoff", 30*time.Second, "maximum backoff between retries")
+	f.DurationVar(&c.retryMaxElapsed, "retry-max-elapsed", 0, "stop retrying an operation after this much time. 0 for no limit")
+	f.BoolVar(&c.preserve, "preserve", false, "preserve the permissions, ownership and modification time of files copied from and to Kubernetes")
+	f.StringVar(&c.symlinks, "symlinks", skbn.SymlinksSkip, "how to copy symbolic links in Kubernetes: skip, follow (copy the files they point to) or copy (as symbolic links)")
+	f.BoolVar(&c.emptyDirs, "empty-dirs", false, "copy empty directories")
+	f.BoolVar(&c.noMultiplex, "no-multiplex", false, "open an exec session per file, instead of transferring many small files from (or to) Kubernetes over a single exec session per container")
+	f.BoolVar(&c.noServerCopy, "no-server-copy", false, "stream S3 to S3 and Azure Blob Storage to Azure Blob Storage copies through skbn, instead of copying the files on the server")
+	f.BoolVar(&c.fanOut, "fan-out", false, "copy from (or to) every ready pod selected by a Kubernetes path. {pod}, {node} and {namespace} in the other path are replaced per pod")
+
+	f.StringVar(&c.kubeconfig, "kubeconfig", "", "path to the kubeconfig file. Default is KUBECONFIG or ~/.kube/config")
+	f.StringVar(&c.context, "context", "", "kubeconfig context to use. Default is the current context")
+	f.StringVar(&c.srcContext, "src-context", "", "kubeconfig context to use for a Kubernetes source. Overrides --context")
+	f.StringVar(&c.dstContext, "dst-context", "", "kubeconfig context to use for a Kubernetes destination. Overrides --context")
+	f.StringVar(&c.as, "as", "", "username to impersonate in Kubernetes")
+	f.StringArrayVar(&c.asGroups, "as-group", nil, "group to impersonate in Kubernetes. This flag can be repeated to specify multiple groups")
+	f.BoolVar(&c.debugContainer, "debug-container", false, "run commands in an ephemeral debug container attached to the target container, for images without a shell or coreutils")
+	f.StringVar(&c.debugImage, "debug-image", skbn.DefaultDebugImage, "image of the ephemeral debug container")
+	f.StringVar(&c.execTransport, "exec-transport", skbn.ExecTransportAuto, "transport of commands run in Kubernetes containers: auto (WebSocket, falling back to SPDY), websocket or spdy")
+	f.StringVar(&c.helperImage, "helper-image", skbn.DefaultHelperImage, "image of the helper pods created to access pvc:// paths")
+	f.StringToStringVar(&c.helperAffinity, "helper-node-affinity", nil, "node labels (key=value) helper pods must be scheduled on")
+	f.StringArrayVar(&c.helperTolerate, "helper-toleration", nil, "toleration of helper pods, of the form key[=value][:effect]. This flag can be repeated")
+	f.BoolVar(&c.snapshot, "snapshot", false, "copy a pvc:// source from a volume snapshot of the claim, for a point-in-time consistent copy")
+	f.StringVar(&c.snapshotClass, "snapshot-class", "", "volume snapshot class of the snapshot. Default is the cluster's default class")
+	f.StringVar(&c.preHook, "pre-hook", "", "shell command to run in the Kubernetes containers before the copy starts")
+	f.StringVar(&c.postHook, "post-hook", "", "shell command to run in the Kubernetes containers after the copy ends, even if it failed")
+	f.StringVar(&c.hookTarget, "hook-target", skbn.HookTargetSrc, "run the hooks in the source (src) or destination (dst) containers")
+
+}
+
+// reportEntry is a transfer in a JSON report
+type reportEntry struct {
+	Src      string  `json:"src"`
+	Dst      string  `json:"dst"`
+	Files    int64   `json:"files"`
+	Bytes    int64   `json:"bytes"`
+	Duration float64 `json:"durationSeconds"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// copyManifest runs the transfers of a manifest, with opts as the options they don't set, and prints a report
+func (c *cpCmd) copyManifest(cmd *cobra.Command, opts skbn.CopyOptions) error {
+	m, err := skbn.ReadManifest(c.manifest)
+	if err != nil {
+		return err
+	}
+	parallel := c.parallel
+	if m.Parallel != nil && !cmd.Flags().Changed("parallel") {
+		parallel = *m.Parallel
+	}
+
+	reports, copyErr := skbn.CopyMany(m.Apply(opts), parallel)
+
+	var entries []reportEntry
+	var files, bytes int64
+	for _, r := range reports {
+		status, e := "ok", reportEntry{Src: r.Src, Dst: r.Dst, Files: r.Files, Bytes: r.Bytes, Duration: r.Duration.Seconds()}
+		if r.Err != nil {
+			status, e.Error = "failed", r.Err.Error()
+		}
+		entries = append(entries, e)
+		files += r.Files
+		bytes += r.Bytes
+		fmt.Fprintf(c.out, "%-6s  %s -> %s  %d files  %s  %s\n", status, r.Src, r.Dst, r.Files, humanSize(r.Bytes), r.Duration.Round(time.Millisecond))
+		if r.Err != nil {
+			fmt.Fprintf(c.out, "        %v\n", r.Err)
+		}
+	}
+	fmt.Fprintf(c.out, "%d transfers, %d files, %s\n", len(reports), files, humanSize(bytes))
+
+	if c.report != "" {
+		data, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(c.report, append(data, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+
+	return copyErr
+}
+
+// k8sClientOptions returns the Kubernetes client options for a side of the copy with the given context
+func (c *cpCmd) k8sClientOptions(sideContext string, helperPod skbn.HelperPodOptions) skbn.K8sClientOptions {
+	context := c.context
+	if sideContext != "" {
+		context = sideContext
+	}
+	opts := skbn.K8sClientOptions{
+		Kubeconfig:    c.kubeconfig,
+		Context:       context,
+		As:            c.as,
+		AsGroups:      c.asGroups,
+		HelperPod:     helperPod,
+		Snapshot:      skbn.SnapshotOptions{Enabled: c.snapshot, Class: c.snapshotClass},
+		ExecTransport: c.execTransport,
+	}
+	if c.debugContainer {
+		opts.DebugImage = c.debugImage
+	}
+	return opts
+}
+
+// helperPodOptions returns the options of helper pods created to access persistent volume claims
+func (c *cpCmd) helperPodOptions() (skbn.HelperPodOptions, error) {
+	opts := skbn.HelperPodOptions{Image: c.helperImage, NodeAffinity: c.helperAffinity}
+	for _, s := range c.helperTolerate {
+		t, err := skbn.ParseToleration(s)
+		if err != nil {
+			return opts, err
+		}
+		opts.Tolerations = append(opts.Tolerations, t)
+	}
+	return opts, nil
+}
+
+type lsCmd struct {
+	recursive     bool
+	output        string
+	kubeconfig    string
+	context       string
+	as            string
+	asGroups      []string
+	execTransport string
+
+	out io.Writer
+}
+
+// lsEntry is a listed file in JSON output
+type lsEntry struct {
+	Path       string     `json:"path"`
+	Size       int64      `json:"size"`
+	ModTime    *time.Time `json:"modTime,omitempty"`
+	Dir        bool       `json:"dir,omitempty"`
+	LinkTarget string     `json:"linkTarget,omitempty"`
+}
+
+// NewLsCmd represents the list command
+func NewLsCmd(out io.Writer) *cobra.Command {
+	c := &lsCmd{out: out}
+
+	cmd := &cobra.Command{
+		Use:   "ls <path>",
+		Short: "List files in Kubernetes or Cloud storage",
+		Long:  ``,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if c.output != "text" && c.output != "json" {
+				log.Fatalf("illegal output format: %s", c.output)
+			}
+			files, err := skbn.List(args[0], skbn.ListOptions{
+				Recursive: c.recursive,
+				K8s: skbn.K8sClientOptions{
+					Kubeconfig:    c.kubeconfig,
+					Context:       c.context,
+					As:            c.as,
+					AsGroups:      c.asGroups,
+					ExecTransport: c.execTransport,
+				},
+			})
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := c.print(args[0], files); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	f := cmd.Flags()
+
+	f.BoolVarP(&c.recursive, "recursive", "r", false, "list the files in subdirectories. Default lists each subdirectory with the total size of its files")
+	f.StringVarP(&c.output, "output", "o", "text", "output format: text or json")
+	f.StringVar(&c.kubeconfig, "kubeconfig", "", "path to the kubeconfig file. Default is KUBECONFIG or ~/.kube/config")
+	f.StringVar(&c.context, "context", "", "kubeconfig context to use. Default is the current context")
+	f.StringVar(&c.as, "as", "", "username to impersonate in Kubernetes")
+	f.StringArrayVar(&c.asGroups, "as-group", nil, "group to impersonate in Kubernetes. This flag can be repeated to specify multiple groups")
+	f.StringVar(&c.execTransport, "exec-transport", skbn.ExecTransportAuto, "transport of commands run in Kubernetes containers: auto (WebSocket, falling back to SPDY), websocket or spdy")
 
-	cmd.MarkFlagRequired("src")
-	cmd.MarkFlagRequired("dst")
+	return cmd
+}
+
+// print writes the listed files in the output format
+func (c *lsCmd) print(listed string, files []skbn.FileInfo) error {
+	if c.output == "json" {
+		entries := []lsEntry{}
+		for _, f := range files {
+			e := lsEntry{Path: lsName(listed, f), Size: f.Size, Dir: f.IsDir, LinkTarget: f.LinkTarget}
+			if !f.ModTime.IsZero() {
+				modTime := f.ModTime
+				e.ModTime = &modTime
+			}
+			entries = append(entries, e)
+		}
+		encoder := json.NewEncoder(c.out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}
+
+	for _, f := range files {
+		size, modTime := "-", "-"
+		if f.Size >= 0 {
+			size = humanSize(f.Size)
+		}
+		if !f.ModTime.IsZero() {
+			modTime = f.ModTime.Local().Format("2006-01-02 15:04:05")
+		}
+		name := lsName(listed, f)
+		if strings.ContainsAny(name, "\n\t\r") {
+			name = strconv.Quote(name)
+		}
+		switch {
+		case f.IsDir:
+			name += "/"
+		case f.LinkTarget != "":
+			name += " -> " + f.LinkTarget
+		}
+		if _, err := fmt.Fprintf(c.out, "%7s  %s  %s\n", size, modTime, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lsName returns the name of a listed file relative to the listed path, or the name of the listed file itself
+func lsName(listed string, f skbn.FileInfo) string {
+	if name := strings.Trim(f.RelativePath, "/"); name != "" {
+		return name
+	}
+	return path.Base(strings.TrimSuffix(listed, "/"))
+}
+
+// humanSize returns a size in bytes with a binary unit, such as 1.5K
+func humanSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return strconv.FormatInt(size, 10)
+	}
+	value, exp := float64(size)/unit, 0
+	for value >= unit && exp < 5 {
+		value /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%c", value, "KMGTPE"[exp])
+}
+
+type rmCmd struct {
+	recursive     bool
+	include       []string
+	exclude       []string
+	dryRun        bool
+	yes           bool
+	parallel      int
+	kubeconfig    string
+	context       string
+	as            string
+	asGroups      []string
+	execTransport string
+
+	out io.Writer
+}
+
+// NewRmCmd represents the remove command
+func NewRmCmd(out io.Writer) *cobra.Command {
+	c := &rmCmd{out: out}
+
+	cmd := &cobra.Command{
+		Use:   "rm <path>",
+		Short: "Remove files from Kubernetes or Cloud storage",
+		Long:  ``,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			opts := skbn.RemoveOptions{
+				Recursive: c.recursive,
+				Include:   c.include,
+				Exclude:   c.exclude,
+				DryRun:    c.dryRun,
+				Parallel:  c.parallel,
+				K8s: skbn.K8sClientOptions{
+					Kubeconfig:    c.kubeconfig,
+					Context:       c.context,
+					As:            c.as,
+					AsGroups:      c.asGroups,
+					ExecTransport: c.execTransport,
+				},
+			}
+			if !c.yes {
+				opts.Confirm = func(files []skbn.FileInfo) bool {
+					return c.confirm(args[0], files)
+				}
+			}
+			files, err := skbn.Remove(args[0], opts)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			action := "removed"
+			if c.dryRun {
+				action = "would remove"
+			}
+			for _, f := range files {
+				fmt.Fprintf(c.out, "%s: %s\n", action, lsName(args[0], f))
+			}
+		},
+	}
+	f := cmd.Flags()
+
+	f.BoolVarP(&c.recursive, "recursive", "r", false, "remove the files under a directory or prefix")
+	f.StringArrayVar(&c.include, "include", nil, "remove only the files matching this pattern (relative path or name). This flag can be repeated")
+	f.StringArrayVar(&c.exclude, "exclude", nil, "keep the files matching this pattern (relative path or name). This flag can be repeated")
+	f.BoolVar(&c.dryRun, "dry-run", false, "list the files that would be removed, without removing them")
+	f.BoolVarP(&c.yes, "yes", "y", false, "remove without asking for confirmation")
+	f.IntVarP(&c.parallel, "parallel", "p", 10, "number of Azure blobs to remove in parallel. set this flag to 0 for full parallelism")
+	f.StringVar(&c.kubeconfig, "kubeconfig", "", "path to the kubeconfig file. Default is KUBECONFIG or ~/.kube/config")
+	f.StringVar(&c.context, "context", "", "kubeconfig context to use. Default is the current context")
+	f.StringVar(&c.as, "as", "", "username to impersonate in Kubernetes")
+	f.StringArrayVar(&c.asGroups, "as-group", nil, "group to impersonate in Kubernetes. This flag can be repeated to specify multiple groups")
+	f.StringVar(&c.execTransport, "exec-transport", skbn.ExecTransportAuto, "transport of commands run in Kubernetes containers: auto (WebSocket, falling back to SPDY), websocket or spdy")
 
 	return cmd
 }
 
+// confirm lists the files to remove, and asks for confirmation on stdin
+func (c *rmCmd) confirm(removed string, files []skbn.FileInfo) bool {
+	for _, f := range files {
+		fmt.Fprintf(c.out, "remove: %s\n", lsName(removed, f))
+	}
+	fmt.Fprintf(c.out, "Remove %d files from %s? [y/N] ", len(files), removed)
+
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
+
 var (
 	// GitTag stands for a git tag
 	GitTag string
@@ -83,6 +540,56 @@ var (
 	GitCommit string
 )
 
+type catCmd struct {
+	verbose       bool
+	kubeconfig    string
+	context       string
+	as            string
+	asGroups      []string
+	execTransport string
+
+	out io.Writer
+}
+
+// NewCatCmd represents the cat command
+func NewCatCmd(out io.Writer) *cobra.Command {
+	c := &catCmd{out: out}
+
+	cmd := &cobra.Command{
+		Use:   "cat <path>...",
+		Short: "Write files in Kubernetes or Cloud storage to stdout",
+		Long:  ``,
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			opts := skbn.CopyOptions{
+				Verbose: c.verbose,
+				SrcK8s: skbn.K8sClientOptions{
+					Kubeconfig:    c.kubeconfig,
+					Context:       c.context,
+					As:            c.as,
+					AsGroups:      c.asGroups,
+					ExecTransport: c.execTransport,
+				},
+			}
+			for _, src := range args {
+				if err := skbn.CopyToWriter(src, c.out, opts); err != nil {
+					log.Fatal(err)
+				}
+			}
+		},
+	}
+	f := cmd.Flags()
+
+	f.BoolVarP(&c.verbose, "verbose", "v", false, "verbose output")
+	f.StringVar(&c.kubeconfig, "kubeconfig", "", "path to the kubeconfig file. Default is KUBECONFIG or ~/.kube/config")
+	f.StringVar(&c.context, "context", "", "kubeconfig context to use. Default is the current context")
+	f.StringVar(&c.as, "as", "", "username to impersonate in Kubernetes")
+	f.StringArrayVar(&c.asGroups, "as-group", nil, "group to impersonate in Kubernetes. This flag can be repeated to specify multiple groups")
+	f.StringVar(&c.execTransport, "exec-transport", skbn.ExecTransportAuto, "transport of commands run in Kubernetes containers: auto (WebSocket, falling back to SPDY), websocket or spdy")
+
+	return cmd
+}
+
 // NewVersionCmd prints version information
 func NewVersionCmd(out io.Writer) *cobra.Command {
 	cmd := &cobra.Command{
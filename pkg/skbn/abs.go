@@ -1,24 +1,36 @@
 package skbn
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/nuvo/skbn/pkg/utils"
+
 	"github.com/Azure/azure-pipeline-go/pipeline"
 	"github.com/Azure/azure-storage-blob-go/azblob"
 )
 
 // GetClientToAbs checks the connection to azure blob storage and returns the tested client (pipeline)
 func GetClientToAbs(ctx context.Context, path string) (pipeline.Pipeline, error) {
+	return getClientToAbs(ctx, path, utils.DefaultRetryPolicy())
+}
+
+func getClientToAbs(ctx context.Context, path string, retry utils.RetryPolicy) (pipeline.Pipeline, error) {
 	pSplit := strings.Split(path, "/")
 	a, c, _ := initAbsVariables(pSplit)
-	pl, err := getNewPipeline()
+	pl, err := getNewPipeline(retry)
 	if err != nil {
 		return nil, err
 	}
@@ -39,6 +51,12 @@ func GetClientToAbs(ctx context.Context, path string) (pipeline.Pipeline, error)
 
 // GetListOfFilesFromAbs gets list of files in path from azure blob storage (recursive)
 func GetListOfFilesFromAbs(ctx context.Context, iClient interface{}, path string) ([]string, error) {
+	files, err := getListOfFilesFromAbs(ctx, iClient, path)
+	return relativePaths(files), err
+}
+
+// getListOfFilesFromAbs lists the blobs in path with their size and modification time
+func getListOfFilesFromAbs(ctx context.Context, iClient interface{}, path string) ([]FileInfo, error) {
 	pSplit := strings.Split(path, "/")
 	if err := validateAbsPath(pSplit); err != nil {
 		return nil, err
@@ -50,19 +68,35 @@ func GetListOfFilesFromAbs(ctx context.Context, iClient interface{}, path string
 		return nil, err
 	}
 
-	bl := []string{}
+	bl := []FileInfo{}
 	for marker := (azblob.Marker{}); marker.NotDone(); {
-		listBlob, err := cu.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{})
+		listBlob, err := cu.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{
+			Details: azblob.BlobListingDetails{Metadata: true},
+			Prefix:  p,
+		})
 		if err != nil {
 			return nil, err
 		}
 
 		marker = listBlob.NextMarker
 		for _, blobInfo := range listBlob.Segment.BlobItems {
-			if !strings.Contains(blobInfo.Name, p) {
+			// The listing prefix matches partial names as well, dir matches dirty/file
+			rel, ok := utils.TrimPathPrefix(blobInfo.Name, p)
+			if !ok {
 				continue
 			}
-			bl = append(bl, strings.Replace(blobInfo.Name, p, "", 1))
+			size := int64(-1)
+			if blobInfo.Properties.ContentLength != nil {
+				size = *blobInfo.Properties.ContentLength
+			}
+			bl = append(bl, FileInfo{
+				RelativePath: rel,
+				Size:         size,
+				Attrs:        attrsFromMetadata(blobInfo.Metadata),
+				IsDir:        strings.HasSuffix(blobInfo.Name, "/") && size == 0,
+				LinkTarget:   linkFromMetadata(blobInfo.Metadata),
+				ModTime:      blobInfo.Properties.LastModified,
+			})
 		}
 	}
 
@@ -101,6 +135,11 @@ func DownloadFromAbs(ctx context.Context, iClient interface{}, path string, writ
 
 // UploadToAbs uploads a single file to azure blob storage
 func UploadToAbs(ctx context.Context, iClient interface{}, toPath, fromPath string, reader io.Reader, verbose bool) error {
+	return uploadToAbs(ctx, iClient, toPath, fromPath, reader, -1, nil, nil, utils.DefaultRetryPolicy(), verbose)
+}
+
+// uploadToAbs uploads a single file to azure blob storage, with attrs stored as blob metadata if they are not nil
+func uploadToAbs(ctx context.Context, iClient interface{}, toPath, fromPath string, reader io.Reader, size int64, attrs *FileAttrs, journal *Journal, retry utils.RetryPolicy, verbose bool) error {
 	pSplit := strings.Split(toPath, "/")
 	if err := validateAbsPath(pSplit); err != nil {
 		return err
@@ -119,10 +158,16 @@ func UploadToAbs(ctx context.Context, iClient interface{}, toPath, fromPath stri
 	}
 
 	bu := getBlobURL(cu, p)
+	metadata := azblob.Metadata(attrs.metadata())
+
+	if journal != nil {
+		return uploadToAbsBlocks(ctx, bu, toPath, reader, size, metadata, journal, retry, verbose)
+	}
 
 	_, err = azblob.UploadStreamToBlockBlob(ctx, reader, bu, azblob.UploadStreamToBlockBlobOptions{
-		BufferSize: 4 * 1024 * 1024,
-		MaxBuffers: 16,
+		BufferSize: absBlockSize,
+		MaxBuffers: absMaxBuffers,
+		Metadata:   metadata,
 	})
 	if err != nil {
 		return err
@@ -131,6 +176,159 @@ func UploadToAbs(ctx context.Context, iClient interface{}, toPath, fromPath stri
 	return nil
 }
 
+const (
+	absBlockSize    = 4 * 1024 * 1024    // 4 MB
+	absMaxBlockSize = 4000 * 1024 * 1024 // 4000 MB, the maximal size of a block
+	absMaxBlocks    = 50000              // maximal number of blocks in a blob
+	absMaxBuffers   = 16                 // number of blocks of absBlockSize uploaded in parallel
+)
+
+// uploadToAbsBlocks uploads a stream to azure blob storage block by block, with several blocks staged in parallel,
+// using predictable block IDs. The upload is recorded in the journal under journalKey,
+// and a recorded upload is continued from its last consecutive staged block
+func uploadToAbsBlocks(ctx context.Context, bu azblob.BlockBlobURL, journalKey string, reader io.Reader, size int64, metadata azblob.Metadata, journal *Journal, retry utils.RetryPolicy, verbose bool) error {
+	blockSize := int64(absBlockSize)
+	if size > blockSize*absMaxBlocks {
+		blockSize = (size + absMaxBlocks - 1) / absMaxBlocks
+	}
+	if blockSize > absMaxBlockSize {
+		blockSize = absMaxBlockSize
+	}
+
+	var ids []string
+	if u, ok := journal.Upload(journalKey); ok && u.PartSize != 0 {
+		staged, offset, err := listStagedBlocks(ctx, bu)
+		if err == nil {
+			if verbose {
+				log.Printf("Resuming upload to %s after %d blocks (%d bytes)", bu.String(), len(staged), offset)
+			}
+			if _, err := io.CopyN(io.Discard, reader, offset); err != nil {
+				return err
+			}
+			blockSize = u.PartSize
+			ids = staged
+		} else if verbose {
+			log.Printf("Can not resume upload to %s, starting over: %v", bu.String(), err)
+		}
+	}
+	if len(ids) == 0 {
+		if err := journal.StartUpload(journalKey, JournalUpload{PartSize: blockSize}); err != nil {
+			return err
+		}
+	}
+
+	// Each attempt is given as long as staging a block takes, and larger blocks are staged fewer at a time
+	pl, err := newAbsPipeline(retry, absTryTimeout(blockSize))
+	if err != nil {
+		return err
+	}
+	bu = bu.WithPipeline(pl)
+	parallel := int(absMaxBuffers * absBlockSize / blockSize)
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var mu sync.Mutex
+	var stageErr error
+	free := make(chan []byte, parallel)
+	bwg := utils.NewBoundedWaitGroup(parallel)
+	failed := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return stageErr
+	}
+	for failed() == nil {
+		var buf []byte
+		select {
+		case buf = <-free:
+		default:
+			buf = make([]byte, blockSize)
+		}
+		n, err := io.ReadFull(reader, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			bwg.Wait()
+			return err
+		}
+		if len(ids) == absMaxBlocks {
+			bwg.Wait()
+			return fmt.Errorf("upload exceeds the maximum of %d blocks", absMaxBlocks)
+		}
+
+		id := absBlockID(len(ids))
+		ids = append(ids, id)
+		bwg.Add(1)
+		go func(id string, buf []byte, n int) {
+			defer bwg.Done()
+			_, sErr := bu.StageBlock(ctx, id, bytes.NewReader(buf[:n]), azblob.LeaseAccessConditions{}, nil, azblob.ClientProvidedKeyOptions{})
+			select {
+			case free <- buf:
+			default:
+			}
+
+			if sErr != nil {
+				mu.Lock()
+				defer mu.Unlock()
+				if stageErr == nil {
+					stageErr = sErr
+					cancel()
+				}
+			}
+		}(id, buf, n)
+
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+	bwg.Wait()
+	if stageErr != nil {
+		return stageErr
+	}
+
+	_, err = bu.CommitBlockList(ctx, ids, azblob.BlobHTTPHeaders{}, metadata, azblob.BlobAccessConditions{}, azblob.DefaultAccessTier, nil, azblob.ClientProvidedKeyOptions{}, azblob.ImmutabilityPolicyOptions{})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// listStagedBlocks returns the IDs of the consecutive blocks already staged by uploadToAbsBlocks and their total size
+func listStagedBlocks(ctx context.Context, bu azblob.BlockBlobURL) ([]string, int64, error) {
+	bl, err := bu.GetBlockList(ctx, azblob.BlockListUncommitted, azblob.LeaseAccessConditions{})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	staged := make(map[string]int64)
+	for _, b := range bl.UncommittedBlocks {
+		staged[b.Name] = b.Size
+	}
+
+	var ids []string
+	var offset int64
+	for {
+		id := absBlockID(len(ids))
+		blockSize, ok := staged[id]
+		if !ok {
+			break
+		}
+		ids = append(ids, id)
+		offset += blockSize
+	}
+
+	return ids, offset, nil
+}
+
+// absBlockID returns the base64 encoded ID of the i-th block in a blob
+func absBlockID(i int) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("skbn-%08d", i)))
+}
+
 func validateAbsPath(pathSplit []string) error {
 	if len(pathSplit) >= 1 {
 		return nil
@@ -146,34 +344,123 @@ func initAbsVariables(split []string) (string, string, string) {
 	return account, container, path
 }
 
-func getNewPipeline() (pipeline.Pipeline, error) {
-	accountName, accountKey := os.Getenv("AZURE_STORAGE_ACCOUNT"), os.Getenv("AZURE_STORAGE_ACCESS_KEY")
+func getNewPipeline(retry utils.RetryPolicy) (pipeline.Pipeline, error) {
+	return newAbsPipeline(retry, absTryTimeout(absBlockSize))
+}
 
-	if len(accountName) == 0 {
-		return nil, fmt.Errorf("AZURE_STORAGE_ACCOUNT environment variable is not set")
-	}
-	if len(accountKey) == 0 {
-		return nil, fmt.Errorf("AZURE_STORAGE_ACCESS_KEY environment variable is not set")
+const (
+	absMinTryTimeout = time.Minute     // minimal time allowed for a single request
+	absMinThroughput = 1 * 1024 * 1024 // 1 MB/s, the slowest transfer rate a request is given time for
+)
+
+// absTryTimeout returns the time allowed for a single request transferring size bytes
+func absTryTimeout(size int64) time.Duration {
+	timeout := time.Duration(size/absMinThroughput) * time.Second
+	if timeout < absMinTryTimeout {
+		timeout = absMinTryTimeout
 	}
+	return timeout
+}
 
-	credential, err := azblob.NewSharedKeyCredential(accountName, accountKey)
+// newAbsPipeline returns a pipeline retrying failed requests according to retry, with tryTimeout allowed for each attempt.
+// It is built like azblob.NewPipeline, with a policy stopping the retries after retry.MaxElapsedTime
+func newAbsPipeline(retry utils.RetryPolicy, tryTimeout time.Duration) (pipeline.Pipeline, error) {
+	credential, err := getAbsCredential()
 	if err != nil {
 		return nil, err
 	}
 
-	po := azblob.PipelineOptions{
-		Retry: azblob.RetryOptions{
+	retry = retry.WithDefaults()
+	f := []pipeline.Factory{
+		azblob.NewTelemetryPolicyFactory(azblob.TelemetryOptions{}),
+		azblob.NewUniqueRequestIDPolicyFactory(),
+		absStartPolicyFactory(),
+		azblob.NewRetryPolicyFactory(azblob.RetryOptions{
 			Policy:        azblob.RetryPolicyExponential,
-			MaxTries:      3,
-			TryTimeout:    time.Second * 3,
-			RetryDelay:    time.Second * 1,
-			MaxRetryDelay: time.Second * 3,
-		},
+			MaxTries:      int32(retry.MaxAttempts),
+			TryTimeout:    tryTimeout,
+			RetryDelay:    retry.InitialBackoff,
+			MaxRetryDelay: retry.MaxBackoff,
+		}),
+		absElapsedPolicyFactory(retry.MaxElapsedTime),
+		credential,
+		azblob.NewRequestLogPolicyFactory(azblob.RequestLogOptions{}),
+		pipeline.MethodFactoryMarker(),
 	}
 
-	pl := azblob.NewPipeline(credential, po)
+	return pipeline.NewPipeline(f, pipeline.Options{}), nil
+}
 
-	return pl, nil
+// absTries tracks the attempts of a request
+type absTries struct {
+	start      time.Time
+	attempts   int
+	lastErr    error
+	lastStatus int // status code of the last response, 0 if there was none
+}
+
+type absTriesKey struct{}
+
+// absStartPolicyFactory records when a request is first attempted, for absElapsedPolicyFactory
+func absStartPolicyFactory() pipeline.Factory {
+	return pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			return next.Do(context.WithValue(ctx, absTriesKey{}, &absTries{start: time.Now()}), request)
+		}
+	})
+}
+
+// absElapsedPolicyFactory runs for each attempt of a request, and fails an attempt started maxElapsed after the first one
+// with the error (or the status) of the previous attempt, whether it failed with an error or a retried status.
+// The retry policy does not retry such an error. 0 for no limit
+func absElapsedPolicyFactory(maxElapsed time.Duration) pipeline.Factory {
+	return pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			tries, ok := ctx.Value(absTriesKey{}).(*absTries)
+			if !ok || maxElapsed <= 0 {
+				return next.Do(ctx, request)
+			}
+			if tries.attempts > 0 && time.Since(tries.start) > maxElapsed {
+				if tries.lastErr != nil {
+					return nil, fmt.Errorf("stopped retrying after %v: %w", maxElapsed, tries.lastErr)
+				}
+				return nil, fmt.Errorf("stopped retrying after %v: last attempt failed with status %d", maxElapsed, tries.lastStatus)
+			}
+			response, err := next.Do(ctx, request)
+			tries.attempts++
+			tries.lastErr, tries.lastStatus = err, 0
+			if response != nil && response.Response() != nil {
+				tries.lastStatus = response.Response().StatusCode
+			}
+			return response, err
+		}
+	})
+}
+
+// absRetryable marks errors that retrying will not fix as permanent
+func absRetryable(err error) error {
+	var stErr azblob.StorageError
+	if errors.As(err, &stErr) && stErr.Response() != nil {
+		switch stErr.Response().StatusCode {
+		case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusConflict, http.StatusPreconditionFailed:
+			return utils.Permanent(err)
+		}
+	}
+	return err
+}
+
+// getAbsCredential returns the shared key credential of the storage account set in the environment
+func getAbsCredential() (*azblob.SharedKeyCredential, error) {
+	accountName, accountKey := os.Getenv("AZURE_STORAGE_ACCOUNT"), os.Getenv("AZURE_STORAGE_ACCESS_KEY")
+
+	if len(accountName) == 0 {
+		return nil, fmt.Errorf("AZURE_STORAGE_ACCOUNT environment variable is not set")
+	}
+	if len(accountKey) == 0 {
+		return nil, fmt.Errorf("AZURE_STORAGE_ACCESS_KEY environment variable is not set")
+	}
+
+	return azblob.NewSharedKeyCredential(accountName, accountKey)
 }
 
 func getServiceURL(pl pipeline.Pipeline, accountName string) (azblob.ServiceURL, error) {
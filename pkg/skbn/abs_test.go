@@ -0,0 +1,86 @@
+package skbn
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// absTestPipeline is the retry part of newAbsPipeline, in front of a policy answering every attempt with do.
+// Like the responders of azblob, it fails a 503 for the retry policy, so absElapsedPolicyFactory sees the status without an error
+func absTestPipeline(maxElapsed time.Duration, attempts *int, do func() (pipeline.Response, error)) pipeline.Pipeline {
+	return pipeline.NewPipeline([]pipeline.Factory{
+		absStartPolicyFactory(),
+		azblob.NewRetryPolicyFactory(azblob.RetryOptions{
+			Policy:        azblob.RetryPolicyFixed,
+			MaxTries:      20,
+			RetryDelay:    5 * time.Millisecond,
+			MaxRetryDelay: 5 * time.Millisecond,
+		}),
+		pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+			return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+				response, err := next.Do(ctx, request)
+				if err == nil && response.Response().StatusCode == http.StatusServiceUnavailable {
+					return response, io.ErrUnexpectedEOF
+				}
+				return response, err
+			}
+		}),
+		absElapsedPolicyFactory(maxElapsed),
+		pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+			return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+				*attempts++
+				return do()
+			}
+		}),
+	}, pipeline.Options{})
+}
+
+func TestAbsElapsedPolicy(t *testing.T) {
+	status := func(code int) func() (pipeline.Response, error) {
+		return func() (pipeline.Response, error) {
+			return pipeline.NewHTTPResponse(&http.Response{StatusCode: code, Header: http.Header{}}), nil
+		}
+	}
+	tests := []struct {
+		name        string
+		maxElapsed  time.Duration
+		do          func() (pipeline.Response, error)
+		minAttempts int
+		maxAttempts int
+		wantErr     string
+	}{
+		{"retried status", 30 * time.Millisecond, status(http.StatusServiceUnavailable), 2, 10, "last attempt failed with status 503"},
+		{"error", 30 * time.Millisecond, func() (pipeline.Response, error) { return nil, io.ErrUnexpectedEOF }, 2, 10, "unexpected EOF"},
+		{"no limit", 0, status(http.StatusServiceUnavailable), 20, 20, ""},
+		{"success", 30 * time.Millisecond, status(http.StatusOK), 1, 1, ""},
+	}
+	u, _ := url.Parse("https://account.blob.core.windows.net/container/blob")
+	for _, tt := range tests {
+		attempts := 0
+		request, err := pipeline.NewRequest(http.MethodGet, *u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = absTestPipeline(tt.maxElapsed, &attempts, tt.do).Do(context.Background(), nil, request)
+		if attempts < tt.minAttempts || attempts > tt.maxAttempts {
+			t.Errorf("%s: got %d attempts, want %d to %d", tt.name, attempts, tt.minAttempts, tt.maxAttempts)
+		}
+		if tt.wantErr == "" {
+			if err != nil && (tt.maxElapsed != 0 || err != io.ErrUnexpectedEOF) {
+				t.Errorf("%s: got error %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), "stopped retrying after 30ms") || !strings.HasSuffix(err.Error(), tt.wantErr) {
+			t.Errorf("%s: got error %v, want it to stop retrying with %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package skbn
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Attributes of files in Kubernetes are stored as object metadata in S3 and Azure Blob Storage,
+// so they can be restored when the files are copied back.
+// Azure metadata names must be valid C# identifiers, so the names have no separators
+const (
+	attrsMetadataMode  = "skbnmode"
+	attrsMetadataUID   = "skbnuid"
+	attrsMetadataGID   = "skbngid"
+	attrsMetadataMtime = "skbnmtime"
+)
+
+// FileAttrs holds the permissions, ownership and modification time of a file
+type FileAttrs struct {
+	Mode    uint32 // permission bits
+	UID     int
+	GID     int
+	ModTime int64 // seconds since the epoch
+}
+
+// metadata returns the attributes as object metadata
+func (a *FileAttrs) metadata() map[string]string {
+	if a == nil {
+		return nil
+	}
+	return map[string]string{
+		attrsMetadataMode:  strconv.FormatUint(uint64(a.Mode), 8),
+		attrsMetadataUID:   strconv.Itoa(a.UID),
+		attrsMetadataGID:   strconv.Itoa(a.GID),
+		attrsMetadataMtime: strconv.FormatInt(a.ModTime, 10),
+	}
+}
+
+// attrsFromMetadata returns the attributes stored in object metadata, or nil if there are none.
+// Metadata names are matched case insensitively, since S3 returns them capitalized
+func attrsFromMetadata(metadata map[string]string) *FileAttrs {
+	values := make(map[string]string)
+	for k, v := range metadata {
+		values[strings.ToLower(k)] = v
+	}
+
+	mode, err := strconv.ParseUint(values[attrsMetadataMode], 8, 32)
+	if err != nil {
+		return nil
+	}
+	uid, err := strconv.Atoi(values[attrsMetadataUID])
+	if err != nil {
+		return nil
+	}
+	gid, err := strconv.Atoi(values[attrsMetadataGID])
+	if err != nil {
+		return nil
+	}
+	mtime, err := strconv.ParseInt(values[attrsMetadataMtime], 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	return &FileAttrs{Mode: uint32(mode), UID: uid, GID: gid, ModTime: mtime}
+}
+
+// parseStatAttrs parses the attributes printed by stat -c "%a %u %g %Y", or returns nil if they can't be parsed
+func parseStatAttrs(mode, uid, gid, mtime string) *FileAttrs {
+	return attrsFromMetadata(map[string]string{
+		attrsMetadataMode:  mode,
+		attrsMetadataUID:   uid,
+		attrsMetadataGID:   gid,
+		attrsMetadataMtime: mtime,
+	})
+}
+
+// completeFromToPair reads the metadata S3 doesn't list: the attributes of files when they are preserved,
+// and the targets of symbolic links, which are stored in empty objects
+func completeFromToPair(srcClient interface{}, srcPrefix string, ftp FromToPair, preserve bool) (FromToPair, error) {
+	if srcPrefix != "s3" || ftp.IsDir || (!preserve && ftp.Size != 0) {
+		return ftp, nil
+	}
+	attrs, link, err := getS3FileAttrs(srcClient, ftp.FromPath)
+	if err != nil {
+		return ftp, err
+	}
+	ftp.Attrs, ftp.LinkTarget = attrs, link
+	return ftp, nil
+}
+
+// k8sAttrsCommand returns a command applying the attributes to a file in a container.
+// Changing the owner requires root, so failing to do so is reported on stderr but doesn't fail the command
+func k8sAttrsCommand(path string, a *FileAttrs) []string {
+	script := `chown "$1" "$4" || echo "can not change the owner of $4" >&2; chmod "$2" "$4" && touch -c -d "@$3" "$4"`
+	return []string{"sh", "-c", script, "sh", fmt.Sprintf("%d:%d", a.UID, a.GID), strconv.FormatUint(uint64(a.Mode), 8), strconv.FormatInt(a.ModTime, 10), path}
+}
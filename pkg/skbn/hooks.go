@@ -0,0 +1,94 @@
+package skbn
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Hooks are shell commands run in the containers of a Kubernetes source or destination
+// before the copy starts (pre-hook) and after it ends (post-hook), for example to freeze a database.
+// With a debug container, hooks run in the debug container, and SKBN_ROOT is the path of the files of the target container
+
+const (
+	// HookTargetSrc runs the hooks in the source containers
+	HookTargetSrc = "src"
+	// HookTargetDst runs the hooks in the destination containers
+	HookTargetDst = "dst"
+)
+
+// getHookPaths returns the Kubernetes paths of the containers to run the hooks in
+func getHookPaths(srcClient, dstClient interface{}, srcPrefix, dstPrefix, srcPath, dstPath string, opts CopyOptions) (interface{}, []string, error) {
+	client, prefix, path, side := srcClient, srcPrefix, srcPath, "source"
+	switch opts.HookTarget {
+	case "", HookTargetSrc:
+	case HookTargetDst:
+		client, prefix, path, side = dstClient, dstPrefix, dstPath, "destination"
+	default:
+		return nil, nil, fmt.Errorf("illegal hook target: %s", opts.HookTarget)
+	}
+	switch prefix {
+	case "k8s":
+	case "pvc":
+		return nil, nil, fmt.Errorf("hooks can not run in the helper pod of a persistent volume claim %s", side)
+	default:
+		return nil, nil, fmt.Errorf("hooks require a Kubernetes %s", side)
+	}
+
+	if opts.FanOut {
+		paths, _, err := ExpandK8sPath(client, path)
+		return client, paths, err
+	}
+	path, err := ResolveK8sPath(client, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, []string{path}, nil
+}
+
+// runHook runs a shell command in the container of each path.
+// If all is set, the command runs in every container even after a failure and the errors are combined,
+// otherwise it stops at the first failure
+func runHook(iClient interface{}, paths []string, name, hook string, all, verbose bool) error {
+	client := *iClient.(*K8sClient)
+	var errs []error
+	for _, path := range paths {
+		err := runHookInContainer(client, path, name, hook, verbose)
+		if err != nil && !all {
+			return err
+		}
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// runHookInContainer runs a shell command in the container of path, or in its debug container
+func runHookInContainer(client K8sClient, path, name, hook string, verbose bool) error {
+	pSplit := strings.Split(path, "/")
+	if err := validateK8sPath(pSplit); err != nil {
+		return err
+	}
+	namespace, podName, containerName, _ := initK8sVariables(pSplit)
+	execContainer, root, err := client.execTarget(namespace, podName, containerName)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("running %s in %s/%s/%s", name, namespace, podName, containerName)
+	stdout := new(bytes.Buffer)
+	stderr, err := Exec(client, namespace, podName, execContainer, []string{"env", "SKBN_ROOT=" + root, "sh", "-c", hook}, nil, stdout)
+	if verbose && stdout.Len() != 0 {
+		log.Printf("%s STDOUT: %s", name, stdout)
+	}
+	if err != nil {
+		return fmt.Errorf("%s failed in %s/%s/%s: %v: %s", name, namespace, podName, containerName, err, strings.TrimSpace(string(stderr)))
+	}
+	if verbose && len(stderr) != 0 {
+		log.Printf("%s STDERR: %s", name, stderr)
+	}
+
+	return nil
+}
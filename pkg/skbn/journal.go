@@ -0,0 +1,367 @@
+package skbn
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nuvo/skbn/pkg/utils"
+)
+
+// journalStoreInterval is the longest time the progress recorded in a journal in S3 or Azure Blob Storage
+// is only kept locally. Storing it rewrites the whole object
+const journalStoreInterval = 10 * time.Second
+
+// Journal records the progress of a copy in a file, so an interrupted copy can be resumed
+type Journal struct {
+	mu      sync.Mutex
+	file    *os.File
+	remote  *journalRemote // nil for a local journal
+	done    map[journalKey]bool
+	uploads map[string]JournalUpload
+	sources map[string]journalSource
+}
+
+// journalRemote stores a journal kept in S3 or Azure Blob Storage.
+// The journal is written to a local file, which is stored as a whole
+type journalRemote struct {
+	fetch  func(w io.Writer) (bool, error)     // writes the stored journal to w, returns false if there is none
+	store  func(r io.Reader, size int64) error // replaces the stored journal
+	close  func()
+	stored time.Time // when the journal was last stored
+	dirty  bool      // entries were written since
+}
+
+// JournalUpload describes a partially uploaded object
+type JournalUpload struct {
+	UploadID string    // S3 multipart upload ID, empty for Azure Blob Storage
+	PartSize int64     // 0 if the part size grows during the upload
+	Size     int64     // size of the source file, -1 if unknown
+	ModTime  time.Time // modification time of the source file, zero if unknown
+}
+
+// journalSource identifies the version of a source file
+type journalSource struct {
+	size    int64
+	modTime time.Time
+}
+
+type journalKey struct {
+	fromPath string
+	toPath   string
+}
+
+type journalEntry struct {
+	Op       string    `json:"op"`
+	FromPath string    `json:"from,omitempty"`
+	ToPath   string    `json:"to"`
+	UploadID string    `json:"uploadId,omitempty"`
+	PartSize int64     `json:"partSize,omitempty"`
+	Size     int64     `json:"srcSize"`
+	ModTime  time.Time `json:"srcModTime"`
+}
+
+const (
+	journalOpDone   = "done"
+	journalOpUpload = "upload"
+)
+
+// OpenJournal opens the journal in path, a local file or an object in S3 or Azure Blob Storage (s3://... or abs://...).
+// If resume is true, the progress recorded in an existing journal is loaded, otherwise the journal is truncated
+func OpenJournal(path string, resume bool) (*Journal, error) {
+	return openJournal(path, resume, utils.DefaultRetryPolicy())
+}
+
+// openJournal opens the journal in path, accessing a journal in S3 or Azure Blob Storage with retry
+func openJournal(path string, resume bool, retry utils.RetryPolicy) (*Journal, error) {
+	if !strings.Contains(path, "://") {
+		return openJournalFile(path, resume, nil)
+	}
+	remote, err := newJournalRemote(path, retry)
+	if err != nil {
+		return nil, err
+	}
+	j, err := openRemoteJournal(remote, resume)
+	if err != nil {
+		remote.close()
+		return nil, fmt.Errorf("error opening journal %s: %v", path, err)
+	}
+	return j, nil
+}
+
+// newJournalRemote returns the storage of a journal in S3 or Azure Blob Storage
+func newJournalRemote(path string, retry utils.RetryPolicy) (*journalRemote, error) {
+	client, prefix, objectPath, err := openPath(path, K8sClientOptions{}, retry)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "s3" && prefix != "abs" {
+		closeClients(client)
+		return nil, fmt.Errorf("the journal must be a local file, or an object in S3 or Azure Blob Storage, not %s", path)
+	}
+
+	return &journalRemote{
+		fetch: func(w io.Writer) (bool, error) {
+			files, err := getListOfFiles(client, prefix, objectPath, listOptions{}, retry)
+			if err != nil {
+				return false, err
+			}
+			for _, f := range files {
+				if f.RelativePath == "" && !f.IsDir {
+					return true, download(client, prefix, objectPath, w, retry, false)
+				}
+			}
+			return false, nil
+		},
+		store: func(r io.Reader, size int64) error {
+			return upload(client, prefix, objectPath, objectPath, r, size, nil, 0, 0, nil, retry, false)
+		},
+		close: func() {
+			closeClients(client)
+		},
+	}, nil
+}
+
+// openRemoteJournal opens a journal stored by remote, in a temporary local file
+func openRemoteJournal(remote *journalRemote, resume bool) (*Journal, error) {
+	file, err := os.CreateTemp("", "skbn-journal-")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if resume {
+		if _, err := remote.fetch(file); err != nil {
+			os.Remove(file.Name())
+			return nil, err
+		}
+	}
+	j, err := openJournalFile(file.Name(), resume, remote)
+	if err != nil {
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return j, nil
+}
+
+// openJournalFile opens the journal in the local file path, stored by remote if it is not nil
+func openJournalFile(path string, resume bool, remote *journalRemote) (*Journal, error) {
+	j := &Journal{
+		remote:  remote,
+		done:    make(map[journalKey]bool),
+		uploads: make(map[string]JournalUpload),
+		sources: make(map[string]journalSource),
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	unterminated := false
+	if resume {
+		var err error
+		if unterminated, err = j.load(path); err != nil {
+			return nil, err
+		}
+	} else {
+		flags |= os.O_TRUNC
+	}
+
+	file, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	j.file = file
+	// Entries are appended after a partially written last line, not to it
+	if unterminated {
+		if _, err := file.Write([]byte("\n")); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("error writing to journal: %v", err)
+		}
+	}
+	if remote != nil {
+		// A journal started over replaces the stored journal, even if nothing is recorded in it
+		remote.stored, remote.dirty = time.Now(), !resume
+	}
+
+	return j, nil
+}
+
+// load loads the progress recorded in the journal in path, and returns true if its last line is not terminated
+func (j *Journal) load(path string) (bool, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// A partially written last line is expected if the copy was killed
+			continue
+		}
+		switch e.Op {
+		case journalOpDone:
+			j.done[journalKey{e.FromPath, e.ToPath}] = true
+			delete(j.uploads, e.ToPath)
+		case journalOpUpload:
+			j.uploads[e.ToPath] = JournalUpload{UploadID: e.UploadID, PartSize: e.PartSize, Size: e.Size, ModTime: e.ModTime}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return false, err
+	}
+	last := make([]byte, 1)
+	if _, err := file.ReadAt(last, info.Size()-1); err != nil {
+		return false, err
+	}
+	return last[0] != '\n', nil
+}
+
+// Close closes the journal file, storing a journal kept in S3 or Azure Blob Storage
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.remote == nil {
+		return j.file.Close()
+	}
+	err := j.store(true)
+	j.file.Close()
+	os.Remove(j.file.Name())
+	j.remote.close()
+	return err
+}
+
+// IsDone returns true if the copy of fromPath to toPath was completed
+func (j *Journal) IsDone(fromPath, toPath string) bool {
+	if j == nil {
+		return false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.done[journalKey{fromPath, toPath}]
+}
+
+// MarkDone records that the copy of fromPath to toPath was completed
+func (j *Journal) MarkDone(fromPath, toPath string) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.done[journalKey{fromPath, toPath}] = true
+	delete(j.uploads, toPath)
+
+	return j.write(journalEntry{Op: journalOpDone, FromPath: fromPath, ToPath: toPath}, false)
+}
+
+// SetSource sets the size (-1 if unknown) and modification time (zero if unknown) of the source file copied to toPath.
+// A partial upload to toPath is continued only if it was started from the same version of the source
+func (j *Journal) SetSource(toPath string, size int64, modTime time.Time) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.sources[toPath] = journalSource{size: size, modTime: modTime}
+}
+
+// Upload returns the partial upload recorded for toPath, if there is one and its source did not change since
+func (j *Journal) Upload(toPath string) (JournalUpload, bool) {
+	if j == nil {
+		return JournalUpload{}, false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	u, ok := j.uploads[toPath]
+	if !ok {
+		return u, false
+	}
+	if src, ok := j.sources[toPath]; ok && (u.Size != src.size || !u.ModTime.Equal(src.modTime)) {
+		return JournalUpload{}, false
+	}
+	return u, true
+}
+
+// StartUpload records that a partial upload to toPath was started, from the source set with SetSource
+func (j *Journal) StartUpload(toPath string, u JournalUpload) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	u.Size, u.ModTime = -1, time.Time{}
+	if src, ok := j.sources[toPath]; ok {
+		u.Size, u.ModTime = src.size, src.modTime
+	}
+	j.uploads[toPath] = u
+
+	// A partial upload lost with the journal is never resumed, nor aborted, so it is stored right away
+	return j.write(journalEntry{Op: journalOpUpload, ToPath: toPath, UploadID: u.UploadID, PartSize: u.PartSize, Size: u.Size, ModTime: u.ModTime}, true)
+}
+
+// write appends an entry to the journal. A journal kept in S3 or Azure Blob Storage is stored if force is set,
+// or if it was last stored journalStoreInterval ago
+func (j *Journal) write(e journalEntry, force bool) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("error writing to journal: %v", err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+
+	if j.remote == nil {
+		return nil
+	}
+	j.remote.dirty = true
+	return j.store(force || time.Since(j.remote.stored) >= journalStoreInterval)
+}
+
+// store stores a journal kept in S3 or Azure Blob Storage, if force is set and entries were written since it was last stored
+func (j *Journal) store(force bool) error {
+	if !force || !j.remote.dirty {
+		return nil
+	}
+	file, err := os.Open(j.file.Name())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := j.remote.store(file, info.Size()); err != nil {
+		return fmt.Errorf("error storing journal: %v", err)
+	}
+	j.remote.stored, j.remote.dirty = time.Now(), false
+
+	return nil
+}
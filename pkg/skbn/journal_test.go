@@ -0,0 +1,273 @@
+package skbn
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJournalDone(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	j, err := OpenJournal(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.IsDone("a", "b") {
+		t.Error("a -> b is done in a new journal")
+	}
+	if err := j.MarkDone("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if !j.IsDone("a", "b") || j.IsDone("b", "a") || j.IsDone("a", "c") {
+		t.Error("only a -> b should be done")
+	}
+	j.Close()
+
+	j, err = OpenJournal(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !j.IsDone("a", "b") {
+		t.Error("a -> b is not done in the resumed journal")
+	}
+	j.Close()
+
+	j, err = OpenJournal(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.IsDone("a", "b") {
+		t.Error("a -> b is done in a journal started over")
+	}
+	j.Close()
+}
+
+func TestJournalResumeMissing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	j, err := OpenJournal(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if j.IsDone("a", "b") {
+		t.Error("a -> b is done in a new journal")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("journal not created: %v", err)
+	}
+}
+
+func TestJournalUploads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	modTime := time.Unix(1700000000, 0)
+	j, err := OpenJournal(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.SetSource("dst/big", 1000, modTime)
+	if err := j.StartUpload("dst/big", JournalUpload{UploadID: "id", PartSize: 100}); err != nil {
+		t.Fatal(err)
+	}
+	j.SetSource("dst/other", 10, modTime)
+	if err := j.StartUpload("dst/other", JournalUpload{UploadID: "other", PartSize: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.MarkDone("src/other", "dst/other"); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	tests := []struct {
+		name    string
+		size    int64
+		modTime time.Time
+		ok      bool
+	}{
+		{"same source", 1000, modTime, true},
+		{"changed size", 1001, modTime, false},
+		{"changed modification time", 1000, modTime.Add(time.Second), false},
+		{"unknown source", -1, time.Time{}, false},
+	}
+	for _, tt := range tests {
+		j, err := OpenJournal(path, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j.SetSource("dst/big", tt.size, tt.modTime)
+		u, ok := j.Upload("dst/big")
+		if ok != tt.ok {
+			t.Errorf("%s: got upload %v, want %v", tt.name, ok, tt.ok)
+		}
+		if ok && (u.UploadID != "id" || u.PartSize != 100 || u.Size != 1000 || !u.ModTime.Equal(modTime)) {
+			t.Errorf("%s: got upload %+v", tt.name, u)
+		}
+		if _, ok := j.Upload("dst/other"); ok {
+			t.Errorf("%s: the upload of a completed file is resumed", tt.name)
+		}
+		j.Close()
+	}
+}
+
+func TestJournalCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	content := `{"op":"done","from":"a","to":"b","srcSize":0,"srcModTime":"0001-01-01T00:00:00Z"}
+not json
+{"op":"unknown","to":"x","srcSize":0,"srcModTime":"0001-01-01T00:00:00Z"}
+{"op":"done","from":"c","to":"d","srcSize":0,"srcModTime":"0001-01-01T00:00:00Z"}
+{"op":"done","from":"e","to":"f","srcSi`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	j, err := OpenJournal(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !j.IsDone("a", "b") || !j.IsDone("c", "d") || j.IsDone("e", "f") {
+		t.Error("expected a -> b and c -> d to be done, and e -> f not to be")
+	}
+	// Entries are appended on a new line after a partially written last line
+	if err := j.MarkDone("e", "f"); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+	if j, err = OpenJournal(path, true); err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if !j.IsDone("e", "f") {
+		t.Error("e -> f is not done after a partially written line")
+	}
+}
+
+func TestJournalNil(t *testing.T) {
+	var j *Journal
+	j.SetSource("b", 1, time.Time{})
+	if j.IsDone("a", "b") {
+		t.Error("a -> b is done in a nil journal")
+	}
+	if _, ok := j.Upload("b"); ok {
+		t.Error("got an upload from a nil journal")
+	}
+	if err := j.MarkDone("a", "b"); err != nil {
+		t.Error(err)
+	}
+	if err := j.StartUpload("b", JournalUpload{}); err != nil {
+		t.Error(err)
+	}
+	if err := j.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+// memoryRemote stores a journal in memory, counting the times it is stored
+type memoryRemote struct {
+	data     []byte
+	exists   bool
+	stores   int
+	badSizes int // stores of a size other than the data read
+	closed   bool
+}
+
+func (m *memoryRemote) remote() *journalRemote {
+	return &journalRemote{
+		fetch: func(w io.Writer) (bool, error) {
+			if !m.exists {
+				return false, nil
+			}
+			_, err := w.Write(m.data)
+			return true, err
+		},
+		store: func(r io.Reader, size int64) error {
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			if int64(len(data)) != size {
+				m.badSizes++
+			}
+			m.data, m.exists = data, true
+			m.stores++
+			return nil
+		},
+		close: func() {
+			m.closed = true
+		},
+	}
+}
+
+func TestJournalRemote(t *testing.T) {
+	m := &memoryRemote{}
+	j, err := openRemoteJournal(m.remote(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := j.file.Name()
+
+	// Completed files are stored at intervals, partial uploads right away
+	if err := j.MarkDone("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if m.stores != 0 {
+		t.Errorf("journal stored %d times after a completed file, want 0", m.stores)
+	}
+	if err := j.StartUpload("big", JournalUpload{UploadID: "id"}); err != nil {
+		t.Fatal(err)
+	}
+	if m.stores != 1 {
+		t.Errorf("journal stored %d times after a partial upload, want 1", m.stores)
+	}
+	j.remote.stored = time.Now().Add(-journalStoreInterval)
+	if err := j.MarkDone("c", "d"); err != nil {
+		t.Fatal(err)
+	}
+	if m.stores != 2 {
+		t.Errorf("journal stored %d times after the store interval, want 2", m.stores)
+	}
+	if err := j.MarkDone("e", "f"); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if m.stores != 3 || m.badSizes != 0 || !m.closed {
+		t.Errorf("got %d stores (%d of a wrong size), closed %v, want 3 stores and closed", m.stores, m.badSizes, m.closed)
+	}
+	if _, err := os.Stat(local); !os.IsNotExist(err) {
+		t.Errorf("local copy of the journal not removed: %v", err)
+	}
+
+	// A resumed journal is fetched
+	j, err = openRemoteJournal(m.remote(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !j.IsDone("a", "b") || !j.IsDone("c", "d") || !j.IsDone("e", "f") {
+		t.Error("completed files not resumed from the stored journal")
+	}
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if m.stores != 3 {
+		t.Errorf("unchanged journal stored again, %d stores", m.stores)
+	}
+
+	// A journal started over replaces the stored journal, even if nothing is recorded
+	j, err = openRemoteJournal(m.remote(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if m.stores != 4 || len(m.data) != 0 {
+		t.Errorf("got %d stores of %d bytes, want 4 stores of an empty journal", m.stores, len(m.data))
+	}
+}
+
+func TestOpenJournalRemotePrefix(t *testing.T) {
+	if _, err := OpenJournal("k8s://ns/pod/container/journal", false); err == nil {
+		t.Error("expected an error for a journal in Kubernetes")
+	}
+}
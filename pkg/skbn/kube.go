@@ -2,16 +2,24 @@ package skbn
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"os"
+	"math/rand"
+	"net/url"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/nuvo/skbn/pkg/utils"
 
 	core_v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -19,138 +27,298 @@ import (
 	"k8s.io/client-go/tools/remotecommand"
 )
 
+const (
+	defaultContainerAnnotation = "kubectl.kubernetes.io/default-container"
+)
+
 // K8sClient holds a clientset and a config
 type K8sClient struct {
 	ClientSet *kubernetes.Clientset
 	Config    *rest.Config
+	Namespace string // namespace of the current context, used when a path doesn't specify one
+	// DebugImage is the image of ephemeral debug containers to run commands in, instead of the target containers.
+	// Empty to run commands in the target containers
+	DebugImage string
+	HelperPod  HelperPodOptions // helper pods to access persistent volume claims with
+	Snapshot   SnapshotOptions  // copy persistent volume claim sources from volume snapshots
+	// ExecTransport is the transport of commands run in containers: ExecTransportAuto (default),
+	// ExecTransportWebSocket or ExecTransportSPDY
+	ExecTransport string
+
+	debug      *debugContainers
+	helpers    *helperPods
+	transports *execTransports
+	streams    *streamHelpers
+	multiplex  bool // transfer files through stream helpers
+}
+
+// Close stops the stream helpers and the debug containers, and deletes the helper pods and volume snapshots created by the client
+func (client *K8sClient) Close() error {
+	streamErr := client.stopStreamHelpers()
+	debugErr := client.stopDebugContainers()
+	helperErr := client.deleteHelperPods()
+	if err := client.deleteSnapshots(); err != nil {
+		return err
+	}
+	if helperErr != nil {
+		return helperErr
+	}
+	if debugErr != nil {
+		return debugErr
+	}
+	return streamErr
+}
+
+// K8sClientOptions selects the kubeconfig, context and identity used to connect to Kubernetes
+type K8sClientOptions struct {
+	Kubeconfig string   // path to a kubeconfig file, empty to use KUBECONFIG or ~/.kube/config
+	Context    string   // empty to use the current context
+	As         string   // user to impersonate, empty to not impersonate
+	AsGroups   []string // groups to impersonate
+	DebugImage string   // run commands in ephemeral debug containers with this image, empty to run them in the target containers
+	HelperPod  HelperPodOptions
+	Snapshot   SnapshotOptions
+	// ExecTransport is the transport of commands run in containers, empty for ExecTransportAuto
+	ExecTransport string
 }
 
 // GetClientToK8s returns a k8sClient
 func GetClientToK8s() (*K8sClient, error) {
-	var kubeconfig string
-	if kubeConfigPath := os.Getenv("KUBECONFIG"); kubeConfigPath != "" {
-		kubeconfig = kubeConfigPath // CI process
-	} else {
-		kubeconfig = filepath.Join(os.Getenv("HOME"), ".kube", "config") // Development environment
-	}
+	return GetClientToK8sWithOptions(K8sClientOptions{})
+}
 
-	var config *rest.Config
+// GetClientToK8sWithOptions returns a k8sClient for the kubeconfig, context and identity in opts.
+// Without a kubeconfig, skbn assumes it is running in a pod and uses an in-cluster configuration
+func GetClientToK8sWithOptions(opts K8sClientOptions) (*K8sClient, error) {
+	// KUBECONFIG may hold a list of paths, which are merged
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if opts.Kubeconfig != "" {
+		rules.ExplicitPath = opts.Kubeconfig
+	}
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{
+		CurrentContext: opts.Context,
+	})
 
-	_, err := os.Stat(kubeconfig)
+	config, err := clientConfig.ClientConfig()
 	if err != nil {
-		// In cluster configuration
-		config, err = rest.InClusterConfig()
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		// Out of cluster configuration
-		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
-		if err != nil {
-			return nil, err
-		}
+		return nil, err
+	}
+	namespace, _, err := clientConfig.Namespace()
+	if err != nil {
+		return nil, err
+	}
+	if opts.As != "" || len(opts.AsGroups) != 0 {
+		config.Impersonate = rest.ImpersonationConfig{UserName: opts.As, Groups: opts.AsGroups}
 	}
 
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		return nil, err
 	}
-	var client = &K8sClient{ClientSet: clientset, Config: config}
+	var client = &K8sClient{
+		ClientSet:     clientset,
+		Config:        config,
+		Namespace:     namespace,
+		DebugImage:    opts.DebugImage,
+		HelperPod:     opts.HelperPod,
+		Snapshot:      opts.Snapshot,
+		ExecTransport: opts.ExecTransport,
+		debug:         &debugContainers{containers: make(map[debugContainerKey]string)},
+		helpers:       &helperPods{pods: make(map[helperPodKey]*helperPodEntry)},
+		transports:    &execTransports{},
+		streams: &streamHelpers{
+			idle:        make(map[streamHelperKey][]*streamHelper),
+			unsupported: make(map[streamHelperKey]bool),
+		},
+	}
 	return client, nil
 }
 
+// SplitK8sContext removes the context from a Kubernetes path of the form <context>@<namespace>/...,
+// and returns the path and opts with the context set
+func SplitK8sContext(path string, opts K8sClientOptions) (string, K8sClientOptions) {
+	pSplit := strings.SplitN(path, "/", 2)
+	if !strings.Contains(pSplit[0], "@") {
+		return path, opts
+	}
+
+	i := strings.LastIndex(pSplit[0], "@")
+	opts.Context = pSplit[0][:i]
+	pSplit[0] = pSplit[0][i+1:]
+
+	return strings.Join(pSplit, "/"), opts
+}
+
 // GetListOfFilesFromK8s gets list of files in path from Kubernetes (recursive)
 func GetListOfFilesFromK8s(iClient interface{}, path, findType, findName string) ([]string, error) {
+	files, err := getListOfFilesFromK8s(iClient, path, findType, findName, listOptions{}, utils.DefaultRetryPolicy())
+	return relativePaths(files), err
+}
+
+// getListOfFilesFromK8s lists the entries of type findType (as in find -type).
+// For regular files, symbolic links and empty directories are listed as well, as selected by lo
+func getListOfFilesFromK8s(iClient interface{}, path, findType, findName string, lo listOptions, retry utils.RetryPolicy) ([]FileInfo, error) {
 	client := *iClient.(*K8sClient)
 	pSplit := strings.Split(path, "/")
 	if err := validateK8sPath(pSplit); err != nil {
 		return nil, err
 	}
 	namespace, podName, containerName, findPath := initK8sVariables(pSplit)
-	command := []string{"find", findPath, "-type", findType, "-name", findName}
-
-	attempts := 3
-	attempt := 0
-	for attempt < attempts {
-		attempt++
+	execContainer, root, err := client.execTarget(namespace, podName, containerName)
+	if err != nil {
+		return nil, err
+	}
+	// For each batch of files, find prints the number of files, a line of attributes per file,
+	// and the NUL terminated names of the files, which may contain newlines
+	script := `echo $#; stat -c "%f %s %a %u %g %Y" "$@" && printf "%s\0" "$@"`
+	command := []string{"find", root + findPath, "-name", findName, "-exec", "sh", "-c", script, "sh", "{}", "+"}
+	if lo.symlinks == SymlinksFollow {
+		// With -L, -type l only matches broken links, which can't be followed
+		script = `echo $#; stat -L -c "%f %s %a %u %g %Y" "$@" && printf "%s\0" "$@"`
+		command = []string{"find", "-L", root + findPath, "!", "-type", "l", "-name", findName, "-exec", "sh", "-c", script, "sh", "{}", "+"}
+	}
 
+	var entries []k8sEntry
+	err = retry.Do(func(attempt int) error {
 		output := new(bytes.Buffer)
-		stderr, err := Exec(client, namespace, podName, containerName, command, nil, output)
+		stderr, err := Exec(client, namespace, podName, execContainer, command, nil, output)
 		if len(stderr) != 0 {
-			if attempt == attempts {
-				return nil, fmt.Errorf("STDERR: " + (string)(stderr))
-			}
-			utils.Sleep(attempt)
-			continue
+			return k8sStderrError(stderr)
 		}
 		if err != nil {
-			if attempt == attempts {
-				return nil, err
-			}
-			utils.Sleep(attempt)
-			continue
+			return k8sRetryable(err)
 		}
 
-		lines := strings.Split(output.String(), "\n")
-		var outLines []string
-		for _, line := range lines {
-			if line != "" {
-				outLines = append(outLines, strings.Replace(line, findPath, "", 1))
-			}
+		entries, err = parseK8sEntries(output, root+findPath)
+		if err != nil {
+			return utils.Permanent(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	files, links := selectK8sEntries(entries, findType, lo, fmt.Sprintf("%s/%s/%s", namespace, podName, containerName))
+	if len(links) != 0 {
+		if err := readK8sLinks(client, namespace, podName, execContainer, files, links, retry); err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// parseK8sEntries parses the batches of attributes and names printed when listing files under findPath
+func parseK8sEntries(output *bytes.Buffer, findPath string) ([]k8sEntry, error) {
+	var entries []k8sEntry
+	for output.Len() != 0 {
+		line, err := output.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("unexpected output from find: %q", line)
+		}
+		count, err := strconv.Atoi(strings.TrimSpace(line))
+		if err != nil {
+			return nil, fmt.Errorf("unexpected output from find: %q", line)
 		}
 
-		return outLines, nil
+		batch := make([]k8sEntry, count)
+		for i := range batch {
+			line, err := output.ReadString('\n')
+			split := strings.Split(strings.TrimSuffix(line, "\n"), " ")
+			if err != nil || len(split) != 6 {
+				return nil, fmt.Errorf("unexpected output from stat: %q", line)
+			}
+			mode, err := strconv.ParseUint(split[0], 16, 32)
+			if err != nil {
+				return nil, fmt.Errorf("unexpected output from stat: %q", line)
+			}
+			size, err := strconv.ParseInt(split[1], 10, 64)
+			if err != nil {
+				size = -1
+			}
+			batch[i] = k8sEntry{
+				mode: uint32(mode),
+				info: FileInfo{Size: size, Attrs: parseStatAttrs(split[2], split[3], split[4], split[5])},
+			}
+			if attrs := batch[i].info.Attrs; attrs != nil {
+				batch[i].info.ModTime = time.Unix(attrs.ModTime, 0)
+			}
+		}
+		for i := range batch {
+			name, err := output.ReadString(0)
+			if err != nil {
+				return nil, fmt.Errorf("unexpected output from find: %q", name)
+			}
+			name = strings.TrimSuffix(name, "\x00")
+			rel, ok := utils.TrimPathPrefix(name, findPath)
+			if !ok {
+				return nil, fmt.Errorf("unexpected path from find: %q", name)
+			}
+			batch[i].path = name
+			batch[i].info.RelativePath = rel
+		}
+		entries = append(entries, batch...)
 	}
 
-	return nil, nil
+	return entries, nil
 }
 
 // DownloadFromK8s downloads a single file from Kubernetes
 func DownloadFromK8s(iClient interface{}, path string, writer io.Writer, verbose bool) error {
+	return downloadFromK8s(iClient, path, writer, utils.DefaultRetryPolicy(), verbose)
+}
+
+func downloadFromK8s(iClient interface{}, path string, writer io.Writer, retry utils.RetryPolicy, verbose bool) error {
 	client := *iClient.(*K8sClient)
 	pSplit := strings.Split(path, "/")
 	if err := validateK8sPath(pSplit); err != nil {
 		return err
 	}
 	namespace, podName, containerName, pathToCopy := initK8sVariables(pSplit)
-	command := []string{"cat", pathToCopy}
+	execContainer, root, err := client.execTarget(namespace, podName, containerName)
+	if err != nil {
+		return err
+	}
+	command := []string{"cat", root + pathToCopy}
+	cw := &countingWriter{writer: writer}
 
-	attempts := 3
-	attempt := 0
-	for attempt < attempts {
-		attempt++
+	return retry.Do(func(attempt int) error {
 		if verbose {
 			log.Printf("Attempt %d to download file from %s/%s/%s:%s", attempt, namespace, podName, containerName, pathToCopy)
 		}
 
-		stderr, err := Exec(client, namespace, podName, containerName, command, nil, writer)
+		var stderr []byte
+		var err error
+		streamed := false
+		if client.multiplex {
+			stderr, streamed, err = client.streamRead(namespace, podName, execContainer, root+pathToCopy, cw, verbose)
+		}
+		if !streamed {
+			stderr, err = Exec(client, namespace, podName, execContainer, command, nil, cw)
+		}
 
 		if (verbose && len(stderr) != 0) || err != nil {
 			log.Printf("STDERR: %s", stderr)
 			log.Printf("Error: %v", err)
 		}
-		if attempt == attempts {
-			log.Printf("this was last attempt")
+		if err != nil {
 			if len(stderr) != 0 {
-				log.Printf("STDERR: %s", stderr)
-				return fmt.Errorf("STDERR: " + (string)(stderr))
-			}
-			if err != nil {
-				log.Printf("Error: %v", err)
-				return err
+				return streamRetryable(k8sStderrError(stderr), cw.n)
 			}
+			return streamRetryable(k8sRetryable(err), cw.n)
 		}
-		if err == nil {
-			return nil
-		}
-		utils.Sleep(attempt)
-	}
-
-	return nil
+		return nil
+	})
 }
 
 // UploadToK8s uploads a single file to Kubernetes
 func UploadToK8s(iClient interface{}, toPath, fromPath string, reader io.Reader, verbose bool) error {
+	return uploadToK8s(iClient, toPath, fromPath, reader, nil, utils.DefaultRetryPolicy(), verbose)
+}
+
+// uploadToK8s uploads a single file to Kubernetes, and applies attrs to it if they are not nil
+func uploadToK8s(iClient interface{}, toPath, fromPath string, reader io.Reader, attrs *FileAttrs, retry utils.RetryPolicy, verbose bool) error {
 	client := *iClient.(*K8sClient)
 	pSplit := strings.Split(toPath, "/")
 	if err := validateK8sPath(pSplit); err != nil {
@@ -161,84 +329,167 @@ func UploadToK8s(iClient interface{}, toPath, fromPath string, reader io.Reader,
 		pSplit = append(pSplit, fileName)
 	}
 	namespace, podName, containerName, pathToCopy := initK8sVariables(pSplit)
-
-	attempts := 3
-	attempt := 0
-	for attempt < attempts {
-		attempt++
-		dir, _ := filepath.Split(pathToCopy)
-		command := []string{"mkdir", "-p", dir}
-		stderr, err := Exec(client, namespace, podName, containerName, command, nil, nil)
-
-		if len(stderr) != 0 {
-			if attempt == attempts {
-				return fmt.Errorf("STDERR: " + (string)(stderr))
+	execContainer, root, err := client.execTarget(namespace, podName, containerName)
+	if err != nil {
+		return err
+	}
+	// The file is written to a temporary file next to it (or to the file a symbolic link points to),
+	// and renamed when it is complete, so the file is never seen half written, and a failed copy doesn't truncate it
+	tmpSuffix := fmt.Sprintf("skbn-%x", rand.Uint32())
+	cr := &countingReader{reader: reader}
+
+	if client.multiplex {
+		streamed := false
+		err := retry.Do(func(attempt int) error {
+			stderr, ok, err := client.streamWrite(namespace, podName, execContainer, root+pathToCopy, tmpSuffix, cr, attrs, verbose)
+			if !ok {
+				return nil
 			}
-			utils.Sleep(attempt)
-			continue
-		}
-		if err != nil {
-			if attempt == attempts {
-				return err
+			streamed = true
+			if err != nil {
+				if len(stderr) != 0 {
+					return streamRetryable(k8sStderrError(stderr), cr.n)
+				}
+				return streamRetryable(k8sRetryable(err), cr.n)
 			}
-			utils.Sleep(attempt)
-			continue
+			if len(stderr) != 0 {
+				log.Printf("Warning: %s/%s/%s:%s: %s", namespace, podName, containerName, pathToCopy, strings.TrimSpace(string(stderr)))
+			}
+			return nil
+		})
+		if streamed || err != nil {
+			return err
 		}
+	}
 
-		command = []string{"touch", pathToCopy}
-		stderr, err = Exec(client, namespace, podName, containerName, command, nil, nil)
-
+	var resolved bytes.Buffer
+	err = retry.Do(func(attempt int) error {
+		resolved.Reset()
+		command := []string{"sh", "-c", `mkdir -p "${1%/*}/" && { readlink -f -- "$1" 2>/dev/null || printf '%s\n' "$1"; }`, "sh", root + pathToCopy}
+		stderr, err := Exec(client, namespace, podName, execContainer, command, nil, &resolved)
 		if len(stderr) != 0 {
-			if attempt == attempts {
-				return fmt.Errorf("STDERR: " + (string)(stderr))
-			}
-			utils.Sleep(attempt)
-			continue
-		}
-		if err != nil {
-			if attempt == attempts {
-				return err
-			}
-			utils.Sleep(attempt)
-			continue
+			return k8sStderrError(stderr)
 		}
+		return k8sRetryable(err)
+	})
+	if err != nil {
+		return err
+	}
+	targetPath := strings.TrimSuffix(resolved.String(), "\n")
+	if targetPath == "" {
+		targetPath = root + pathToCopy
+	}
+	dir, fileName := filepath.Split(targetPath)
+	tmpPath := fmt.Sprintf("%s.%s.%s", dir, fileName, tmpSuffix)
 
-		command = []string{"cp", "/dev/stdin", pathToCopy}
-		stderr, err = Exec(client, namespace, podName, containerName, command, readerWrapper{reader}, nil)
-
+	err = retry.Do(func(attempt int) error {
+		if verbose {
+			log.Printf("Attempt %d to upload file to %s/%s/%s:%s", attempt, namespace, podName, containerName, pathToCopy)
+		}
+		stderr, err := Exec(client, namespace, podName, execContainer, []string{"cp", "/dev/stdin", tmpPath}, cr, nil)
+		// SPDY ends stdin at a read error as if the file was complete, so the copy is never renamed over the file
+		if cr.err != nil {
+			return streamRetryable(cr.err, cr.n)
+		}
 		if len(stderr) != 0 {
-			if attempt == attempts {
-				return fmt.Errorf("STDERR: " + (string)(stderr))
-			}
-			utils.Sleep(attempt)
-			continue
+			return streamRetryable(k8sStderrError(stderr), cr.n)
 		}
 		if err != nil {
-			if attempt == attempts {
-				return err
-			}
-			utils.Sleep(attempt)
-			continue
+			return streamRetryable(k8sRetryable(err), cr.n)
 		}
 		return nil
+	})
+	if err == nil && attrs != nil {
+		err = retry.Do(func(attempt int) error {
+			stderr, err := Exec(client, namespace, podName, execContainer, k8sAttrsCommand(tmpPath, attrs), nil, nil)
+			if err != nil {
+				if len(stderr) != 0 {
+					return k8sStderrError(stderr)
+				}
+				return k8sRetryable(err)
+			}
+			if len(stderr) != 0 {
+				log.Printf("Warning: %s/%s/%s:%s: %s", namespace, podName, containerName, pathToCopy, strings.TrimSpace(string(stderr)))
+			}
+			return nil
+		})
+	}
+	if err == nil {
+		err = retry.Do(func(attempt int) error {
+			stderr, err := Exec(client, namespace, podName, execContainer, k8sReplaceCommand(tmpPath, targetPath, attrs != nil), nil, nil)
+			if len(stderr) != 0 {
+				return k8sStderrError(stderr)
+			}
+			return k8sRetryable(err)
+		})
+	}
+	if err != nil {
+		if _, rmErr := Exec(client, namespace, podName, execContainer, []string{"rm", "-f", tmpPath}, nil, nil); rmErr != nil {
+			log.Printf("error removing temporary file %s/%s/%s:%s: %v", namespace, podName, containerName, tmpPath, rmErr)
+		}
+		return err
 	}
 
 	return nil
 }
 
-type readerWrapper struct {
-	reader io.Reader
+// k8sReplaceFunc is a shell function renaming the temporary file $1 over the file $2.
+// Unless attributes were applied to the temporary file ($3 is set), it gets the owner and mode of the file it replaces.
+// A file which can not be replaced, such as a file mounted by itself (subPath), is written in place instead
+const k8sReplaceFunc = `replace() {
+	if [ -z "$3" ] && a=$(stat -c '%u:%g %a' -- "$2" 2>/dev/null); then
+		chown "${a% *}" "$1" 2>/dev/null; chmod "${a#* }" "$1"
+	fi
+	e=$(mv -f -- "$1" "$2" 2>&1) && return
+	case $e in
+	*"esource busy"*|*"ross-device"*)
+		cat -- "$1" >"$2" || return
+		if [ -n "$3" ] && a=$(stat -c '%u:%g %a' -- "$1"); then
+			chown "${a% *}" "$2" 2>/dev/null; chmod "${a#* }" "$2" && touch -c -r "$1" "$2" || return
+		fi
+		rm -f -- "$1" ;;
+	*)
+		printf '%s\n' "$e" >&2; return 1 ;;
+	esac
+}`
+
+// k8sReplaceCommand returns the command renaming tmpPath over path, see k8sReplaceFunc
+func k8sReplaceCommand(tmpPath, path string, attrs bool) []string {
+	attrsArg := ""
+	if attrs {
+		attrsArg = "attrs"
+	}
+	return []string{"sh", "-c", k8sReplaceFunc + "\nreplace \"$@\"", "sh", tmpPath, path, attrsArg}
+}
+
+// k8sRetryable marks errors that retrying will not fix as permanent
+func k8sRetryable(err error) error {
+	var status apierrors.APIStatus
+	if errors.As(err, &status) {
+		switch status.Status().Reason {
+		case metav1.StatusReasonNotFound, metav1.StatusReasonUnauthorized, metav1.StatusReasonForbidden, metav1.StatusReasonBadRequest:
+			return utils.Permanent(err)
+		}
+	}
+	return err
 }
 
-func (r readerWrapper) Read(p []byte) (int, error) {
-	return r.reader.Read(p)
+// k8sStderrError returns an error for the output of a failed command, marked as permanent if retrying will not fix it
+func k8sStderrError(stderr []byte) error {
+	err := fmt.Errorf("STDERR: %s", stderr)
+	for _, msg := range []string{"No such file or directory", "Permission denied", "not found", "Read-only file system"} {
+		if strings.Contains(string(stderr), msg) {
+			return utils.Permanent(err)
+		}
+	}
+	return err
 }
 
-// Exec executes a command in a given container
+// Exec executes a command in a given container, over WebSocket or SPDY according to client.ExecTransport
 func Exec(client K8sClient, namespace, podName, containerName string, command []string, stdin io.Reader, stdout io.Writer) ([]byte, error) {
-	clientset, config := client.ClientSet, client.Config
+	clientset := client.ClientSet
 
-	req := clientset.Core().RESTClient().Post().
+	req := clientset.CoreV1().RESTClient().Post().
 		Resource("pods").
 		Name(podName).
 		Namespace(namespace).
@@ -258,25 +509,238 @@ func Exec(client K8sClient, namespace, podName, containerName string, command []
 		TTY:       false,
 	}, parameterCodec)
 
-	exec, err := remotecommand.NewSPDYExecutor(config, "POST", req.URL())
+	exec, err := client.newExecutor(req.URL())
 	if err != nil {
-		return nil, fmt.Errorf("error while creating Executor: %v", err)
+		return nil, fmt.Errorf("error while creating Executor: %w", err)
 	}
 
 	var stderr bytes.Buffer
-	err = exec.Stream(remotecommand.StreamOptions{
+	err = exec.StreamWithContext(context.Background(), remotecommand.StreamOptions{
 		Stdin:  stdin,
 		Stdout: stdout,
 		Stderr: &stderr,
 		Tty:    false,
 	})
 	if err != nil {
-		return nil, fmt.Errorf("error in Stream: %v", err)
+		return stderr.Bytes(), fmt.Errorf("error in Stream: %w", upgradeCause(err))
 	}
 
 	return stderr.Bytes(), nil
 }
 
+// ResolveK8sPath replaces a pod selector in a Kubernetes path with the name of a ready pod it selects.
+// An empty namespace is replaced with the namespace of the current context,
+// and an empty container is replaced with the default container of the pod.
+// The pod can be selected by:
+// <namespace>/<podName>/... - the pod itself
+// <namespace>/-l <labelSelector>/... - a pod matching the label selector
+// <namespace>/deploy/<deploymentName>/... - a pod of the deployment
+// <namespace>/sts/<statefulSetName>/... - a pod of the stateful set
+// <namespace>/sts/<statefulSetName>/<ordinal>/... - the pod of the stateful set with the ordinal
+func ResolveK8sPath(iClient interface{}, path string) (string, error) {
+	pSplit := strings.Split(path, "/")
+	if len(pSplit) < 2 {
+		return "", fmt.Errorf("illegal path: %s", path)
+	}
+	podSpec, rest := splitK8sPodSpec(pSplit[1:])
+	defaultContainer := len(rest) > 0 && rest[0] == ""
+	if pSplit[0] != "" && len(podSpec) == 1 && !isK8sLabelSelector(podSpec[0]) && !defaultContainer {
+		return path, nil
+	}
+
+	paths, _, err := ExpandK8sPath(iClient, path)
+	if err != nil {
+		return "", err
+	}
+
+	return paths[0], nil
+}
+
+// ExpandK8sPath returns a path for each ready pod selected in a Kubernetes path (see ResolveK8sPath), and the pods
+func ExpandK8sPath(iClient interface{}, path string) ([]string, []core_v1.Pod, error) {
+	pSplit := strings.Split(path, "/")
+	if len(pSplit) < 2 {
+		return nil, nil, fmt.Errorf("illegal path: %s", path)
+	}
+	namespace := pSplit[0]
+	if namespace == "" {
+		namespace = iClient.(*K8sClient).Namespace
+	}
+	podSpec, rest := splitK8sPodSpec(pSplit[1:])
+
+	pods, err := getK8sPods(iClient, namespace, podSpec)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var paths []string
+	for _, pod := range pods {
+		podRest := append([]string{}, rest...)
+		if len(podRest) > 0 && podRest[0] == "" {
+			container, err := getDefaultContainer(pod)
+			if err != nil {
+				return nil, nil, err
+			}
+			podRest[0] = container
+		}
+		paths = append(paths, strings.Join(append([]string{namespace, pod.Name}, podRest...), "/"))
+	}
+
+	return paths, pods, nil
+}
+
+// ExpandPodPlaceholders replaces {pod}, {node} and {namespace} in path with the values of the pod
+func ExpandPodPlaceholders(path string, pod core_v1.Pod) string {
+	return strings.NewReplacer("{pod}", pod.Name, "{node}", pod.Spec.NodeName, "{namespace}", pod.Namespace).Replace(path)
+}
+
+// getDefaultContainer returns the container to use in a pod when a path doesn't specify one:
+// the container in the kubectl.kubernetes.io/default-container annotation, or the only container of the pod
+func getDefaultContainer(pod core_v1.Pod) (string, error) {
+	if container := pod.Annotations[defaultContainerAnnotation]; container != "" {
+		return container, nil
+	}
+	if len(pod.Spec.Containers) == 1 {
+		return pod.Spec.Containers[0].Name, nil
+	}
+
+	var containers []string
+	for _, c := range pod.Spec.Containers {
+		containers = append(containers, c.Name)
+	}
+	return "", fmt.Errorf("pod %s/%s has more than one container, specify one of: %s", pod.Namespace, pod.Name, strings.Join(containers, ", "))
+}
+
+// getK8sPods returns the ready pods selected by podSpec (see ResolveK8sPath), sorted by name
+func getK8sPods(iClient interface{}, namespace string, podSpec []string) ([]core_v1.Pod, error) {
+	client := *iClient.(*K8sClient)
+	pods := client.ClientSet.CoreV1().Pods(namespace)
+
+	var selector string
+	switch {
+	case isK8sLabelSelector(podSpec[0]):
+		selector = strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(podSpec[0], "-l"), "="))
+		var err error
+		if selector, err = url.PathUnescape(selector); err != nil {
+			return nil, fmt.Errorf("illegal label selector %s: %v", podSpec[0], err)
+		}
+	case len(podSpec) == 2 && isK8sDeployment(podSpec[0]):
+		deploy, err := client.ClientSet.AppsV1().Deployments(namespace).Get(context.Background(), podSpec[1], metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		ls, err := metav1.LabelSelectorAsSelector(deploy.Spec.Selector)
+		if err != nil {
+			return nil, err
+		}
+		selector = ls.String()
+	case len(podSpec) == 2 && isK8sStatefulSet(podSpec[0]):
+		sts, err := client.ClientSet.AppsV1().StatefulSets(namespace).Get(context.Background(), podSpec[1], metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		ls, err := metav1.LabelSelectorAsSelector(sts.Spec.Selector)
+		if err != nil {
+			return nil, err
+		}
+		selector = ls.String()
+	case len(podSpec) == 3 && isK8sStatefulSet(podSpec[0]):
+		pod, err := pods.Get(context.Background(), podSpec[1]+"-"+podSpec[2], metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if !isK8sPodReady(pod) {
+			return nil, fmt.Errorf("pod %s/%s is not ready", namespace, pod.Name)
+		}
+		return []core_v1.Pod{*pod}, nil
+	default:
+		pod, err := pods.Get(context.Background(), podSpec[0], metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return []core_v1.Pod{*pod}, nil
+	}
+
+	list, err := pods.List(context.Background(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	var ready []core_v1.Pod
+	for _, pod := range list.Items {
+		if isK8sPodReady(&pod) {
+			ready = append(ready, pod)
+		}
+	}
+	if len(ready) == 0 {
+		return nil, fmt.Errorf("no ready pods found in namespace %s for %s", namespace, strings.Join(podSpec, "/"))
+	}
+	sort.Slice(ready, func(i, j int) bool { return ready[i].Name < ready[j].Name })
+
+	return ready, nil
+}
+
+// splitK8sPodSpec splits the segments of a path after the namespace to the pod selector and the rest of the path
+func splitK8sPodSpec(split []string) ([]string, []string) {
+	switch {
+	case len(split) >= 4 && isK8sStatefulSet(split[0]) && isK8sOrdinal(split[2]):
+		return split[:3], split[3:]
+	case len(split) >= 3 && (isK8sDeployment(split[0]) || isK8sStatefulSet(split[0])):
+		return split[:2], split[2:]
+	}
+	return split[:1], split[1:]
+}
+
+// unescapeK8sPath decodes the URL escaped components of a Kubernetes path like utils.UnescapePath,
+// except for an escaped / (%2F) in a label selector, which getK8sPods decodes after the path is split
+func unescapeK8sPath(path string) (string, error) {
+	pSplit := strings.SplitN(path, "/", 3)
+	if len(pSplit) < 2 {
+		return utils.UnescapePath(path)
+	}
+	selector, err := utils.UnescapePath(pSplit[1])
+	if err != nil || !isK8sLabelSelector(selector) {
+		return utils.UnescapePath(path)
+	}
+	pSplit[1] = strings.NewReplacer("%", "%25", "/", "%2F").Replace(selector)
+	for _, i := range []int{0, 2} {
+		if i < len(pSplit) {
+			if pSplit[i], err = utils.UnescapePath(pSplit[i]); err != nil {
+				return "", err
+			}
+		}
+	}
+	return strings.Join(pSplit, "/"), nil
+}
+
+func isK8sLabelSelector(s string) bool {
+	return strings.HasPrefix(s, "-l ") || strings.HasPrefix(s, "-l=")
+}
+
+func isK8sDeployment(s string) bool {
+	return s == "deploy" || s == "deployment" || s == "deployments"
+}
+
+func isK8sStatefulSet(s string) bool {
+	return s == "sts" || s == "statefulset" || s == "statefulsets"
+}
+
+func isK8sOrdinal(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+func isK8sPodReady(pod *core_v1.Pod) bool {
+	if pod.Status.Phase != core_v1.PodRunning || pod.DeletionTimestamp != nil {
+		return false
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type == core_v1.PodReady {
+			return c.Status == core_v1.ConditionTrue
+		}
+	}
+	return false
+}
+
 func validateK8sPath(pathSplit []string) error {
 	if len(pathSplit) >= 3 {
 		return nil
@@ -0,0 +1,151 @@
+package skbn
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	core_v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// A debug container is an ephemeral container running a helper image next to a target container.
+// It shares the process namespace of the target, so the files of the target are accessible
+// through /proc/1/root, and the binaries skbn needs don't have to exist in the target image
+
+const (
+	// DefaultDebugImage is the image of debug containers when none is set
+	DefaultDebugImage = "busybox:stable"
+
+	debugContainerRoot    = "/proc/1/root"
+	debugContainerDone    = "/tmp/skbn-done"
+	debugContainerTimeout = 2 * time.Minute
+)
+
+type debugContainers struct {
+	mu         sync.Mutex
+	containers map[debugContainerKey]string
+}
+
+type debugContainerKey struct {
+	namespace string
+	pod       string
+	container string
+}
+
+// execTarget returns the container in which commands for the files of a container run,
+// and the prefix of the paths of the container's files there
+func (client K8sClient) execTarget(namespace, podName, containerName string) (string, string, error) {
+	if client.DebugImage == "" {
+		return containerName, "", nil
+	}
+
+	if client.debug == nil {
+		return "", "", fmt.Errorf("debug containers require a client from GetClientToK8sWithOptions")
+	}
+	client.debug.mu.Lock()
+	defer client.debug.mu.Unlock()
+
+	key := debugContainerKey{namespace, podName, containerName}
+	if name, ok := client.debug.containers[key]; ok {
+		return name, debugContainerRoot, nil
+	}
+
+	name, err := startDebugContainer(client, namespace, podName, containerName)
+	if err != nil {
+		return "", "", err
+	}
+	client.debug.containers[key] = name
+
+	return name, debugContainerRoot, nil
+}
+
+// stopDebugContainers stops the helper processes of all the debug containers started by the client.
+// Ephemeral containers can not be removed from a pod, they remain terminated until the pod is deleted
+func (client K8sClient) stopDebugContainers() error {
+	if client.debug == nil {
+		return nil
+	}
+	client.debug.mu.Lock()
+	defer client.debug.mu.Unlock()
+
+	var lastErr error
+	for key, name := range client.debug.containers {
+		command := []string{"touch", debugContainerDone}
+		if _, err := Exec(client, key.namespace, key.pod, name, command, nil, nil); err != nil {
+			lastErr = fmt.Errorf("error stopping debug container %s in %s/%s: %v", name, key.namespace, key.pod, err)
+		}
+		delete(client.debug.containers, key)
+	}
+
+	return lastErr
+}
+
+func startDebugContainer(client K8sClient, namespace, podName, containerName string) (string, error) {
+	name := fmt.Sprintf("skbn-%d", rand.Int63())
+	script := fmt.Sprintf("while [ ! -e %s ]; do sleep 1; done", debugContainerDone)
+
+	pods := client.ClientSet.CoreV1().Pods(namespace)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pod, err := pods.Get(context.Background(), podName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, core_v1.EphemeralContainer{
+			EphemeralContainerCommon: core_v1.EphemeralContainerCommon{
+				Name:    name,
+				Image:   client.DebugImage,
+				Command: []string{"sh", "-c", script},
+				SecurityContext: &core_v1.SecurityContext{
+					Capabilities: &core_v1.Capabilities{
+						// Needed to access the files of a target running as another user
+						Add: []core_v1.Capability{"SYS_PTRACE"},
+					},
+				},
+			},
+			TargetContainerName: containerName,
+		})
+		_, err = pods.UpdateEphemeralContainers(context.Background(), podName, pod, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("error adding debug container to %s/%s: %v", namespace, podName, err)
+	}
+
+	if err := waitForDebugContainer(client, namespace, podName, name); err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+func waitForDebugContainer(client K8sClient, namespace, podName, name string) error {
+	deadline := time.Now().Add(debugContainerTimeout)
+	for time.Now().Before(deadline) {
+		pod, err := client.ClientSet.CoreV1().Pods(namespace).Get(context.Background(), podName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		for _, s := range pod.Status.EphemeralContainerStatuses {
+			if s.Name != name {
+				continue
+			}
+			switch {
+			case s.State.Running != nil:
+				return nil
+			case s.State.Terminated != nil:
+				return fmt.Errorf("debug container %s in %s/%s terminated: %s", name, namespace, podName, s.State.Terminated.Reason)
+			case s.State.Waiting != nil && (s.State.Waiting.Reason == "ErrImagePull" || s.State.Waiting.Reason == "ImagePullBackOff" || s.State.Waiting.Reason == "InvalidImageName"):
+				return fmt.Errorf("debug container %s in %s/%s can not start: %s", name, namespace, podName, s.State.Waiting.Message)
+			}
+		}
+
+		time.Sleep(time.Second)
+	}
+
+	return fmt.Errorf("timed out waiting for debug container %s in %s/%s", name, namespace, podName)
+}
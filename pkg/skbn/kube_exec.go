@@ -0,0 +1,101 @@
+package skbn
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// Commands run in containers over the WebSocket exec protocol, or over SPDY when the API server,
+// or a proxy in front of it, doesn't accept WebSocket exec requests.
+// The WebSocket executor of client-go only negotiates version 5 of the protocol (Kubernetes 1.30),
+// which is the first one able to close stdin, so older API servers are reached over SPDY
+
+const (
+	// ExecTransportAuto runs commands over WebSocket, and falls back to SPDY when WebSocket is not supported
+	ExecTransportAuto = "auto"
+	// ExecTransportWebSocket runs commands over WebSocket only
+	ExecTransportWebSocket = "websocket"
+	// ExecTransportSPDY runs commands over SPDY only
+	ExecTransportSPDY = "spdy"
+)
+
+// execTransports remembers that the API server doesn't accept WebSocket exec requests
+type execTransports struct {
+	spdyOnly atomic.Bool
+}
+
+// ValidateExecTransport returns an error if transport is not a known exec transport
+func ValidateExecTransport(transport string) error {
+	switch transport {
+	case "", ExecTransportAuto, ExecTransportWebSocket, ExecTransportSPDY:
+		return nil
+	}
+	return fmt.Errorf("illegal exec transport: %s", transport)
+}
+
+// useWebSocket returns true if a command should be run over WebSocket first
+func (client K8sClient) useWebSocket() bool {
+	switch client.ExecTransport {
+	case ExecTransportSPDY:
+		return false
+	case ExecTransportWebSocket:
+		return true
+	}
+	return client.transports == nil || !client.transports.spdyOnly.Load()
+}
+
+// newExecutor returns an executor of the exec request u, for the transports of client
+func (client K8sClient) newExecutor(u *url.URL) (remotecommand.Executor, error) {
+	spdy, err := remotecommand.NewSPDYExecutor(client.Config, "POST", u)
+	if err != nil || !client.useWebSocket() {
+		return spdy, err
+	}
+	ws, err := remotecommand.NewWebSocketExecutor(client.Config, "GET", u.String())
+	if err != nil || client.ExecTransport == ExecTransportWebSocket {
+		return ws, err
+	}
+	return remotecommand.NewFallbackExecutor(ws, spdy, client.fallBackToSPDY)
+}
+
+// fallBackToSPDY returns true if a command has to be run again over SPDY, as nothing was sent yet,
+// and remembers it if the API server or a proxy rejected the WebSocket protocol itself, rather than the request
+func (client K8sClient) fallBackToSPDY(err error) bool {
+	if !httpstream.IsUpgradeFailure(err) && !httpstream.IsHTTPSProxyError(err) {
+		return false
+	}
+	if client.transports != nil && webSocketUnsupported(err) {
+		client.transports.spdyOnly.Store(true)
+	}
+	return true
+}
+
+// webSocketUnsupported returns true if err is not an error status of the request,
+// or a status rejecting the protocol. WebSocket requests are forbidden by roles granting create on pods/exec
+// (which SPDY requests need) but not get
+func webSocketUnsupported(err error) bool {
+	var status *apierrors.StatusError
+	if !errors.As(upgradeCause(err), &status) {
+		return true
+	}
+	switch status.ErrStatus.Code {
+	case http.StatusBadRequest, http.StatusForbidden, http.StatusMethodNotAllowed, http.StatusUpgradeRequired, http.StatusNotImplemented:
+		return true
+	}
+	return false
+}
+
+// upgradeCause returns the cause of a failed upgrade, so error statuses are classified like the errors of other requests
+func upgradeCause(err error) error {
+	var upgradeErr *httpstream.UpgradeFailureError
+	if errors.As(err, &upgradeErr) && upgradeErr.Cause != nil {
+		return upgradeErr.Cause
+	}
+	return err
+}
@@ -0,0 +1,402 @@
+package skbn
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Copying many small files from (or to) a container opens an exec session per file, which is slow
+// and loads the API server. Instead, a stream helper, a shell started once per container,
+// reads and writes the files over a single exec stream.
+// Requests are lines of an operation and base64 encoded arguments. File contents are read
+// as lines of base64, and written as chunks of a line holding the length of the chunk followed by its bytes,
+// which dd copies without the shell reading a byte at a time, ending with a chunk of length 0.
+// dd reads exactly the bytes of a chunk, with iflag=fullblock, or a byte at a time where it lacks it,
+// so it never reads into the next chunk like a buffered head -c can.
+// A file is written to a temporary file next to it (or to the file a symbolic link points to),
+// which a following request renames over the file, or removes when the copy failed.
+// Every request is answered with a line of "." followed by the exit code and the base64 encoded stderr of the operation.
+// Containers without base64 or a dd able to read exact chunks are accessed with an exec session per file
+
+const (
+	// multiplexMinFiles is the number of files from which small files are multiplexed
+	multiplexMinFiles = 10
+	// multiplexMaxSize is the size of the largest file that is multiplexed, larger files are streamed faster by their own session
+	multiplexMaxSize = 1024 * 1024
+
+	streamHelperReady       = "skbn-stream 1"
+	streamHelperUnsupported = "skbn-stream unsupported"
+	streamHelperStopTimeout = 10 * time.Second
+	// streamHelperLine is the number of bytes encoded in each line of file contents read
+	streamHelperLine = 57
+	// streamHelperChunk is the largest chunk of file contents written
+	streamHelperChunk = 64 * 1024
+)
+
+const streamHelperScript = `exec 3>&1
+command -v base64 >/dev/null 2>&1 || { echo "` + streamHelperUnsupported + `"; exit 0; }
+if [ "$(printf abc | dd iflag=fullblock bs=2 count=1 2>/dev/null)" = ab ]; then
+	chunk() { dd iflag=fullblock bs="$1" count=1 2>/dev/null; }
+elif [ "$(printf abc | dd bs=1 count=2 2>/dev/null)" = ab ]; then
+	chunk() { dd bs=1 count="$1" 2>/dev/null; }
+else
+	echo "` + streamHelperUnsupported + `"; exit 0
+fi
+echo "` + streamHelperReady + `"
+dec() { printf %s "$1" | base64 -d; echo x; }
+reply() { printf '.%d %s\n' "$1" "$(printf %s "$2" | base64 | tr -d '\n')"; }
+payload() { while read -r n && [ "$n" -gt 0 ]; do chunk "$n"; done; }
+tmppath() { r=$(readlink -f -- "$1" 2>/dev/null && echo x) && r=${r%?x} && [ -n "$r" ] || r=$1; tmp=${r%/*}/.${r##*/}.$2; }
+` + k8sReplaceFunc + `
+while read -r op p t o m mt; do
+	p=$(dec "$p"); p=${p%x}
+	case $op in
+	R)
+		err=$(base64 "$p" 2>&1 >&3); reply $? "$err" ;;
+	W)
+		t=$(dec "$t"); t=${t%x}
+		err=$(mkdir -p "${p%/*}/" 2>&1); rc=$?
+		if [ $rc = 0 ]; then
+			tmppath "$p" "$t"
+			err=$(payload | { cat >"$tmp"; rc=$?; cat >/dev/null; exit $rc; } 2>&1); rc=$?
+			[ $rc = 0 ] || rm -f "$tmp"
+		else
+			payload >/dev/null
+		fi
+		reply $rc "$err" ;;
+	C)
+		t=$(dec "$t"); t=${t%x}; tmppath "$p" "$t"; err=; rc=0
+		if [ -n "$o" ]; then
+			err=$({ chown "$o" "$tmp" || echo "can not change the owner of $p" >&2; chmod "$m" "$tmp" && touch -c -d "@$mt" "$tmp"; } 2>&1); rc=$?
+		fi
+		if [ $rc = 0 ]; then
+			e=$(replace "$tmp" "$r" "$o" 2>&1); rc=$?; err="$err$e"
+		fi
+		[ $rc = 0 ] || rm -f "$tmp"
+		reply $rc "$err" ;;
+	A)
+		t=$(dec "$t"); t=${t%x}; tmppath "$p" "$t"; rm -f "$tmp"; reply 0 "" ;;
+	*)
+		reply 1 "unknown request $op" ;;
+	esac
+done
+`
+
+type streamHelpers struct {
+	mu          sync.Mutex
+	idle        map[streamHelperKey][]*streamHelper
+	unsupported map[streamHelperKey]bool
+}
+
+type streamHelperKey struct {
+	namespace string
+	pod       string
+	container string
+}
+
+// streamHelper is a shell serving the file requests of a single copy at a time
+type streamHelper struct {
+	stdin  *io.PipeWriter
+	stdout *bufio.Reader
+	done   chan error
+}
+
+// multiplexed returns a client multiplexing file transfers over stream helpers, for Kubernetes clients
+func multiplexed(iClient interface{}, prefix string) interface{} {
+	switch prefix {
+	case "k8s", "pvc":
+		client := *iClient.(*K8sClient)
+		client.multiplex = true
+		return &client
+	}
+	return iClient
+}
+
+// acquireStreamHelper returns an idle stream helper in a container, starting one if there is none.
+// It returns nil if the container can't run a stream helper
+func (client K8sClient) acquireStreamHelper(namespace, podName, containerName string, verbose bool) *streamHelper {
+	if client.streams == nil {
+		return nil
+	}
+	key := streamHelperKey{namespace, podName, containerName}
+
+	client.streams.mu.Lock()
+	if client.streams.unsupported[key] {
+		client.streams.mu.Unlock()
+		return nil
+	}
+	if idle := client.streams.idle[key]; len(idle) != 0 {
+		h := idle[len(idle)-1]
+		client.streams.idle[key] = idle[:len(idle)-1]
+		client.streams.mu.Unlock()
+		return h
+	}
+	client.streams.mu.Unlock()
+
+	h, err := startStreamHelper(client, namespace, podName, containerName)
+	if err != nil {
+		if verbose {
+			log.Printf("not multiplexing files in %s/%s/%s: %v", namespace, podName, containerName, err)
+		}
+		client.streams.mu.Lock()
+		client.streams.unsupported[key] = true
+		client.streams.mu.Unlock()
+		return nil
+	}
+	return h
+}
+
+// releaseStreamHelper returns a stream helper to the idle helpers, or stops it if it is broken
+func (client K8sClient) releaseStreamHelper(namespace, podName, containerName string, h *streamHelper, broken bool) {
+	if broken {
+		h.stop()
+		return
+	}
+	key := streamHelperKey{namespace, podName, containerName}
+	client.streams.mu.Lock()
+	defer client.streams.mu.Unlock()
+	client.streams.idle[key] = append(client.streams.idle[key], h)
+}
+
+// stopStreamHelpers stops all the idle stream helpers of the client
+func (client K8sClient) stopStreamHelpers() error {
+	if client.streams == nil {
+		return nil
+	}
+	client.streams.mu.Lock()
+	defer client.streams.mu.Unlock()
+
+	var lastErr error
+	for key, helpers := range client.streams.idle {
+		for _, h := range helpers {
+			if err := h.stop(); err != nil {
+				lastErr = fmt.Errorf("error stopping stream helper in %s/%s/%s: %v", key.namespace, key.pod, key.container, err)
+			}
+		}
+		delete(client.streams.idle, key)
+	}
+
+	return lastErr
+}
+
+func startStreamHelper(client K8sClient, namespace, podName, containerName string) (*streamHelper, error) {
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+	h := &streamHelper{
+		stdin:  stdinWriter,
+		stdout: bufio.NewReaderSize(stdoutReader, 64*1024),
+		done:   make(chan error, 1),
+	}
+
+	go func() {
+		stderr, err := Exec(client, namespace, podName, containerName, []string{"sh", "-c", streamHelperScript}, stdinReader, stdoutWriter)
+		if err == nil && len(stderr) != 0 {
+			err = k8sStderrError(stderr)
+		}
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		stdoutWriter.CloseWithError(err)
+		stdinReader.CloseWithError(err)
+		h.done <- err
+	}()
+
+	line, err := h.stdout.ReadString('\n')
+	if err != nil {
+		h.stop()
+		return nil, err
+	}
+	if line = strings.TrimSuffix(line, "\n"); line != streamHelperReady {
+		h.stop()
+		if line == streamHelperUnsupported {
+			return nil, fmt.Errorf("base64 or dd not found")
+		}
+		return nil, fmt.Errorf("unexpected output from stream helper: %q", line)
+	}
+
+	return h, nil
+}
+
+// stop closes the stdin of the helper and waits for it to exit
+func (h *streamHelper) stop() error {
+	h.stdin.Close()
+	select {
+	case err := <-h.done:
+		if err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		return err
+	case <-time.After(streamHelperStopTimeout):
+		return fmt.Errorf("timed out waiting for the stream helper to exit")
+	}
+}
+
+// request sends a request line to the helper
+func (h *streamHelper) request(op string, args ...string) error {
+	line := op
+	for _, arg := range args {
+		line += " " + arg
+	}
+	_, err := io.WriteString(h.stdin, line+"\n")
+	return err
+}
+
+// reply reads the reply to a request. It returns the stderr of the operation, false if the reply can't be read,
+// and an error if the operation failed
+func (h *streamHelper) reply() ([]byte, bool, error) {
+	line, err := h.stdout.ReadString('\n')
+	if err != nil {
+		return nil, false, err
+	}
+	return parseStreamReply(strings.TrimSuffix(line, "\n"))
+}
+
+func parseStreamReply(line string) ([]byte, bool, error) {
+	fields := strings.Fields(strings.TrimPrefix(line, "."))
+	if !strings.HasPrefix(line, ".") || len(fields) == 0 || len(fields) > 2 {
+		return nil, false, fmt.Errorf("unexpected reply from stream helper: %q", line)
+	}
+	rc, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, false, fmt.Errorf("unexpected reply from stream helper: %q", line)
+	}
+	var stderr []byte
+	if len(fields) == 2 {
+		if stderr, err = base64.StdEncoding.DecodeString(fields[1]); err != nil {
+			return nil, false, fmt.Errorf("unexpected reply from stream helper: %q", line)
+		}
+	}
+	if rc != 0 {
+		return stderr, true, fmt.Errorf("command terminated with exit code %d", rc)
+	}
+	return stderr, true, nil
+}
+
+// streamRead reads a file in a container through a stream helper into writer.
+// It returns the stderr of the read like Exec does, and false if the container can't run a stream helper
+func (client K8sClient) streamRead(namespace, podName, containerName, path string, writer io.Writer, verbose bool) ([]byte, bool, error) {
+	h := client.acquireStreamHelper(namespace, podName, containerName, verbose)
+	if h == nil {
+		return nil, false, nil
+	}
+
+	stderr, ok, err := h.read(path, writer)
+	client.releaseStreamHelper(namespace, podName, containerName, h, !ok)
+	return stderr, true, err
+}
+
+// read reads a file into writer. It returns false if the helper can't be used anymore
+func (h *streamHelper) read(path string, writer io.Writer) ([]byte, bool, error) {
+	if err := h.request("R", encodeStreamArg(path)); err != nil {
+		return nil, false, err
+	}
+
+	// A failed write doesn't stop the reply, which is read to the end to reuse the helper
+	var writeErr error
+	for {
+		line, err := h.stdout.ReadString('\n')
+		if err != nil {
+			return nil, false, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if strings.HasPrefix(line, ".") {
+			stderr, ok, err := parseStreamReply(line)
+			if ok && writeErr != nil {
+				return stderr, true, writeErr
+			}
+			return stderr, ok, err
+		}
+		if writeErr != nil {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, false, fmt.Errorf("unexpected output from stream helper: %v", err)
+		}
+		if _, err := writer.Write(data); err != nil {
+			writeErr = err
+		}
+	}
+}
+
+// streamWrite writes a file in a container through a stream helper, to a temporary file ending with tmpSuffix first,
+// and applies attrs to it if they are not nil.
+// It returns the stderr of the write like Exec does, and false if the container can't run a stream helper
+func (client K8sClient) streamWrite(namespace, podName, containerName, path, tmpSuffix string, reader io.Reader, attrs *FileAttrs, verbose bool) ([]byte, bool, error) {
+	h := client.acquireStreamHelper(namespace, podName, containerName, verbose)
+	if h == nil {
+		return nil, false, nil
+	}
+
+	stderr, ok, err := h.write(path, tmpSuffix, reader, attrs)
+	client.releaseStreamHelper(namespace, podName, containerName, h, !ok)
+	return stderr, true, err
+}
+
+// write writes a file to a temporary file ending with tmpSuffix next to path (or to the file path links to),
+// and renames it to path if it was read completely. It returns false if the helper can't be used anymore
+func (h *streamHelper) write(path, tmpSuffix string, reader io.Reader, attrs *FileAttrs) ([]byte, bool, error) {
+	args := []string{encodeStreamArg(path), encodeStreamArg(tmpSuffix)}
+	if err := h.request("W", args...); err != nil {
+		return nil, false, err
+	}
+
+	// The file is sent in chunks, which the helper reads up to the empty chunk, so nothing is left unread on a failure
+	w := bufio.NewWriterSize(h.stdin, streamHelperChunk+32)
+	buf := make([]byte, streamHelperChunk)
+	var readErr error
+	for readErr == nil {
+		var n int
+		n, readErr = io.ReadFull(reader, buf)
+		if n == 0 {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%d\n", n); err != nil {
+			return nil, false, err
+		}
+		if _, err := w.Write(buf[:n]); err != nil {
+			return nil, false, err
+		}
+	}
+	if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+		readErr = nil
+	}
+	if _, err := w.WriteString("0\n"); err != nil {
+		return nil, false, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, false, err
+	}
+	stderr, ok, err := h.reply()
+	if !ok || err != nil {
+		return stderr, ok, err
+	}
+
+	// The file is complete, it is renamed into place, or removed if the read failed
+	if readErr != nil {
+		if err := h.request("A", args...); err != nil {
+			return nil, false, err
+		}
+		_, ok, _ := h.reply()
+		return nil, ok, readErr
+	}
+	if attrs != nil {
+		args = append(args, fmt.Sprintf("%d:%d", attrs.UID, attrs.GID), strconv.FormatUint(uint64(attrs.Mode), 8), strconv.FormatInt(attrs.ModTime, 10))
+	}
+	if err := h.request("C", args...); err != nil {
+		return nil, false, err
+	}
+	return h.reply()
+}
+
+// encodeStreamArg encodes an argument of a request, so it holds no spaces or newlines
+func encodeStreamArg(arg string) string {
+	return base64.StdEncoding.EncodeToString([]byte(arg))
+}
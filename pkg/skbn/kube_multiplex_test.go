@@ -0,0 +1,240 @@
+package skbn
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// startLocalStreamHelper runs the stream helper script in a local shell, as it runs in a container,
+// with env added to its environment
+func startLocalStreamHelper(tb testing.TB, env ...string) *streamHelper {
+	for _, name := range []string{"sh", "base64", "dd"} {
+		if _, err := exec.LookPath(name); err != nil {
+			tb.Skipf("%s not found", name)
+		}
+	}
+	cmd := exec.Command("sh", "-c", streamHelperScript)
+	cmd.Env = append(os.Environ(), env...)
+	stdinReader, stdinWriter := io.Pipe()
+	cmd.Stdin = stdinReader
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		tb.Fatal(err)
+	}
+	h := &streamHelper{
+		stdin:  stdinWriter,
+		stdout: bufio.NewReaderSize(stdout, 64*1024),
+		done:   make(chan error, 1),
+	}
+	go func() {
+		err := cmd.Wait()
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		h.done <- err
+	}()
+	if line, err := h.stdout.ReadString('\n'); err != nil || strings.TrimSuffix(line, "\n") != streamHelperReady {
+		tb.Fatalf("stream helper not ready: %q %v", line, err)
+	}
+	tb.Cleanup(func() { h.stop() })
+	return h
+}
+
+func TestStreamHelperWriteExisting(t *testing.T) {
+	h := startLocalStreamHelper(t)
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	link := filepath.Join(dir, "link")
+	if err := os.WriteFile(target, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("target", link); err != nil {
+		t.Fatal(err)
+	}
+
+	// The link is written through, and the file keeps its mode
+	if stderr, _, err := h.write(link, "tmp", strings.NewReader("new"), nil); err != nil {
+		t.Fatalf("%v: %s", err, stderr)
+	}
+	if fi, err := os.Lstat(link); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("link replaced: %v %v", fi.Mode(), err)
+	}
+	if data, err := os.ReadFile(target); err != nil || string(data) != "new" {
+		t.Errorf("got %q %v, want new", data, err)
+	}
+	if fi, err := os.Stat(target); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("got mode %v %v, want 0600", fi.Mode(), err)
+	}
+
+	// Applied attributes replace the mode
+	attrs := &FileAttrs{Mode: 0640, UID: os.Getuid(), GID: os.Getgid(), ModTime: 1700000000}
+	if stderr, _, err := h.write(target, "tmp", strings.NewReader("attrs"), attrs); err != nil {
+		t.Fatalf("%v: %s", err, stderr)
+	}
+	if fi, err := os.Stat(target); err != nil || fi.Mode().Perm() != 0640 || fi.ModTime().Unix() != 1700000000 {
+		t.Errorf("got mode %v and time %v %v, want 0640 and 1700000000", fi.Mode(), fi.ModTime(), err)
+	}
+
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 2 {
+		t.Errorf("got %d entries %v, want no temporary files left", len(entries), err)
+	}
+}
+
+// streamHelperPayloads are files written and read back through a stream helper: empty files,
+// files ending at and around chunk boundaries, and files holding lines which look like chunk lengths and requests
+var streamHelperPayloads = map[string][]byte{
+	"empty":          {},
+	"byte":           {'x'},
+	"chunk-1":        bytes.Repeat([]byte{'a'}, streamHelperChunk-1),
+	"chunk":          bytes.Repeat([]byte{'b'}, streamHelperChunk),
+	"chunk+1":        bytes.Repeat([]byte{'c'}, streamHelperChunk+1),
+	"chunks":         bytes.Repeat([]byte("skbn\x00\n\xff"), 2*streamHelperChunk/8+3),
+	"lengths":        []byte("0\n5\nabcde\n-1\n\n"),
+	"requests":       []byte("R Lw==\nW Lw== eA==\nA Lw== eA==\n"),
+	"replies":        []byte(".0 \n.1 ZXJy\n."),
+	"no newline":     []byte("last line"),
+	"lengths chunks": bytes.Repeat([]byte("65536\n0\n"), streamHelperChunk/4),
+}
+
+func testStreamHelperRoundTrip(t *testing.T, h *streamHelper) {
+	dir := t.TempDir()
+	// Each file is written twice, so the second write replaces an existing file
+	for i := 0; i < 2; i++ {
+		for name, data := range streamHelperPayloads {
+			path := filepath.Join(dir, "sub", name)
+			if stderr, ok, err := h.write(path, "tmp", bytes.NewReader(data), nil); !ok || err != nil {
+				t.Fatalf("%s: write failed: %v %v: %s", name, ok, err, stderr)
+			}
+			if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, data) {
+				t.Errorf("%s: file holds %d bytes %v, want %d", name, len(got), err, len(data))
+			}
+
+			var buf bytes.Buffer
+			if stderr, ok, err := h.read(path, &buf); !ok || err != nil {
+				t.Fatalf("%s: read failed: %v %v: %s", name, ok, err, stderr)
+			}
+			if !bytes.Equal(buf.Bytes(), data) {
+				t.Errorf("%s: read %d bytes, want %d", name, buf.Len(), len(data))
+			}
+		}
+	}
+
+	// A failed request leaves the helper usable
+	if _, ok, err := h.read(filepath.Join(dir, "missing"), io.Discard); !ok || err == nil {
+		t.Errorf("read of a missing file: got %v %v, want an error", ok, err)
+	}
+	if _, ok, err := h.write(filepath.Join(dir, "sub", "empty", "file"), "tmp", bytes.NewReader(streamHelperPayloads["chunks"]), nil); !ok || err == nil {
+		t.Errorf("write under a file: got %v %v, want an error", ok, err)
+	}
+	data := streamHelperPayloads["lengths"]
+	if stderr, ok, err := h.write(filepath.Join(dir, "after"), "tmp", bytes.NewReader(data), nil); !ok || err != nil {
+		t.Fatalf("write after failures failed: %v %v: %s", ok, err, stderr)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "sub"))
+	if err != nil || len(entries) != len(streamHelperPayloads) {
+		t.Errorf("got %d files %v, want %d and no temporary files", len(entries), err, len(streamHelperPayloads))
+	}
+}
+
+func TestStreamHelperRoundTrip(t *testing.T) {
+	testStreamHelperRoundTrip(t, startLocalStreamHelper(t))
+}
+
+func TestStreamHelperRoundTripByteReads(t *testing.T) {
+	// A dd without iflag=fullblock, as in some busybox builds, reads the chunks a byte at a time
+	dd, err := exec.LookPath("dd")
+	if err != nil {
+		t.Skip("dd not found")
+	}
+	bin := t.TempDir()
+	script := "#!/bin/sh\nfor a; do case $a in iflag=*) echo \"dd: unknown operand $a\" >&2; exit 1;; esac; done\nexec " + dd + " \"$@\"\n"
+	if err := os.WriteFile(filepath.Join(bin, "dd"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	testStreamHelperRoundTrip(t, startLocalStreamHelper(t, "PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH")))
+}
+
+func TestStreamHelperUnsupported(t *testing.T) {
+	// Without a dd at all, files are copied with a session per file
+	bin := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, "dd"), []byte("#!/bin/sh\nexit 127\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("sh", "-c", streamHelperScript)
+	cmd.Env = append(os.Environ(), "PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	out, err := cmd.Output()
+	if err != nil || string(out) != streamHelperUnsupported+"\n" {
+		t.Errorf("got %q %v, want %q", out, err, streamHelperUnsupported)
+	}
+}
+
+func TestParseStreamReply(t *testing.T) {
+	tests := []struct {
+		line   string
+		stderr string
+		ok     bool
+		err    bool
+	}{
+		{".0 ", "", true, false},
+		{".0", "", true, false},
+		{".0 d2Fybg==", "warn", true, false},
+		{".1 ZXJy", "err", true, true},
+		{"0 ", "", false, true},
+		{".x ", "", false, true},
+		{".0 !!", "", false, true},
+		{".0 a b", "", false, true},
+	}
+	for _, tt := range tests {
+		stderr, ok, err := parseStreamReply(tt.line)
+		if string(stderr) != tt.stderr || ok != tt.ok || (err != nil) != tt.err {
+			t.Errorf("%q: got %q %v %v, want %q %v and error %v", tt.line, stderr, ok, err, tt.stderr, tt.ok, tt.err)
+		}
+	}
+}
+
+func BenchmarkStreamHelperWrite(b *testing.B) {
+	h := startLocalStreamHelper(b)
+	dir := b.TempDir()
+	data := bytes.Repeat([]byte("skbn\x00\n\xff"), multiplexMaxSize/8)
+	path := filepath.Join(dir, "file")
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if stderr, _, err := h.write(path, "tmp", bytes.NewReader(data), nil); err != nil {
+			b.Fatalf("%v: %s", err, stderr)
+		}
+	}
+}
+
+func BenchmarkStreamHelperRead(b *testing.B) {
+	h := startLocalStreamHelper(b)
+	dir := b.TempDir()
+	data := bytes.Repeat([]byte("skbn\x00\n\xff"), multiplexMaxSize/8)
+	path := filepath.Join(dir, "file")
+	if stderr, _, err := h.write(path, "tmp", bytes.NewReader(data), nil); err != nil {
+		b.Fatalf("%v: %s", err, stderr)
+	}
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var buf bytes.Buffer
+		if stderr, _, err := h.read(path, &buf); err != nil {
+			b.Fatalf("%v: %s", err, stderr)
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			b.Fatal("read data differs from written data")
+		}
+	}
+}
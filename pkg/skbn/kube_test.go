@@ -0,0 +1,331 @@
+package skbn
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// recordedFind is the output of the listing command of getListOfFilesFromK8s for /data, recorded in two batches.
+// The names hold newlines, tabs, leading dashes, quotes and bytes which are not valid UTF-8
+const recordedFind = "4\n" +
+	"41ed 4096 755 0 0 1792368850\n" +
+	"81a4 4 644 1000 1000 1792368850\n" +
+	"81a4 2 644 1000 1000 1792368850\n" +
+	"41ed 4096 755 0 0 1792368850\n" +
+	"/data\x00" +
+	"/data/bad\xff\xfe\x00" +
+	"/data/tab\tname\x00" +
+	"/data/empty\x00" +
+	"7\n" +
+	"81a4 0 644 1000 1000 1792368850\n" +
+	"a1ff 6 777 0 0 1792368850\n" +
+	"41ed 4096 755 0 0 1792368850\n" +
+	"81a4 8 644 1000 1000 1792368850\n" +
+	"8180 3 600 1000 1000 1792368850\n" +
+	"81a4 1 644 1000 1000 1792368850\n" +
+	"81a4 5 644 1000 1000 1700000000\n" +
+	"/data/quote\"s'\x00" +
+	"/data/link\x00" +
+	"/data/sub\x00" +
+	"/data/sub/file\x00" +
+	"/data/-dash\x00" +
+	"/data/new\nline\x00" +
+	"/data/plain\x00"
+
+func TestParseK8sEntries(t *testing.T) {
+	entries, err := parseK8sEntries(bytes.NewBufferString(recordedFind), "/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		mode uint32
+		path string
+		rel  string
+		size int64
+	}{
+		{0040755, "/data", "", 4096},
+		{0100644, "/data/bad\xff\xfe", "/bad\xff\xfe", 4},
+		{0100644, "/data/tab\tname", "/tab\tname", 2},
+		{0040755, "/data/empty", "/empty", 4096},
+		{0100644, "/data/quote\"s'", "/quote\"s'", 0},
+		{0120777, "/data/link", "/link", 6},
+		{0040755, "/data/sub", "/sub", 4096},
+		{0100644, "/data/sub/file", "/sub/file", 8},
+		{0100600, "/data/-dash", "/-dash", 3},
+		{0100644, "/data/new\nline", "/new\nline", 1},
+		{0100644, "/data/plain", "/plain", 5},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(entries), len(want))
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e.mode != w.mode || e.path != w.path || e.info.RelativePath != w.rel || e.info.Size != w.size {
+			t.Errorf("entry %d: got mode %o path %q relative path %q size %d, want mode %o path %q relative path %q size %d",
+				i, e.mode, e.path, e.info.RelativePath, e.info.Size, w.mode, w.path, w.rel, w.size)
+		}
+	}
+
+	plain := entries[len(entries)-1].info
+	wantAttrs := &FileAttrs{Mode: 0644, UID: 1000, GID: 1000, ModTime: 1700000000}
+	if !reflect.DeepEqual(plain.Attrs, wantAttrs) {
+		t.Errorf("got attributes %+v, want %+v", plain.Attrs, wantAttrs)
+	}
+	if !plain.ModTime.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("got modification time %v, want %v", plain.ModTime, time.Unix(1700000000, 0))
+	}
+}
+
+func TestParseK8sEntriesRoot(t *testing.T) {
+	output := "2\n" +
+		"41ed 4096 755 0 0 1792368850\n" +
+		"81a4 1 644 0 0 1792368850\n" +
+		"/\x00" +
+		"/-n\x00"
+	entries, err := parseK8sEntries(bytes.NewBufferString(output), "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].info.RelativePath != "/" || entries[1].info.RelativePath != "/-n" {
+		t.Errorf("unexpected entries: %+v", entries)
+	}
+}
+
+func TestParseK8sEntriesUnknownSize(t *testing.T) {
+	output := "1\n" +
+		"81a4 ? 644 0 0 1792368850\n" +
+		"/data/file\x00"
+	entries, err := parseK8sEntries(bytes.NewBufferString(output), "/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].info.Size != -1 {
+		t.Errorf("unexpected entries: %+v", entries)
+	}
+}
+
+func TestParseK8sEntriesErrors(t *testing.T) {
+	tests := map[string]string{
+		"truncated count":      "1",
+		"bad count":            "one\n",
+		"missing attributes":   "2\n81a4 1 644 0 0 1792368850\n",
+		"short attributes":     "1\n81a4 1 644 0 0\n/data/file\x00",
+		"bad mode":             "1\nzzzz 1 644 0 0 1792368850\n/data/file\x00",
+		"missing name":         "2\n81a4 1 644 0 0 1792368850\n81a4 1 644 0 0 1792368850\n/data/file\x00",
+		"unterminated name":    "1\n81a4 1 644 0 0 1792368850\n/data/file",
+		"outside listed path":  "1\n81a4 1 644 0 0 1792368850\n/database\x00",
+		"newline for NUL":      "1\n81a4 1 644 0 0 1792368850\n/data/file\n",
+		"name with attributes": "1\n81a4 1 644 0 0 1792368850 /data/file\x00",
+	}
+	for name, output := range tests {
+		if entries, err := parseK8sEntries(bytes.NewBufferString(output), "/data"); err == nil {
+			t.Errorf("%s: expected an error, got %+v", name, entries)
+		}
+	}
+}
+
+func TestSelectK8sEntries(t *testing.T) {
+	entries, err := parseK8sEntries(bytes.NewBufferString(recordedFind), "/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, links := selectK8sEntries(entries, "f", listOptions{symlinks: SymlinksCopy, emptyDirs: true}, "ns/pod/container")
+	var got []string
+	for _, f := range files {
+		got = append(got, f.RelativePath)
+	}
+	want := []string{"/bad\xff\xfe", "/tab\tname", "/quote\"s'", "/link", "/sub/file", "/-dash", "/new\nline", "/plain", "/empty"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got files %q, want %q", got, want)
+	}
+	if len(links) != 1 || links[0].path != "/data/link" || files[links[0].index].RelativePath != "/link" {
+		t.Errorf("unexpected links: %+v", links)
+	}
+	if empty := files[len(files)-1]; !empty.IsDir || empty.Size != 0 {
+		t.Errorf("got %+v, want an empty directory", empty)
+	}
+
+	files, links = selectK8sEntries(entries, "f", listOptions{symlinks: SymlinksSkip}, "ns/pod/container")
+	if len(files) != 7 || len(links) != 0 {
+		t.Errorf("got %d files and %d links, want 7 files and no links", len(files), len(links))
+	}
+
+	files, _ = selectK8sEntries(entries, "d", listOptions{}, "ns/pod/container")
+	if len(files) != 3 {
+		t.Errorf("got %d directories, want 3", len(files))
+	}
+}
+
+func TestParseK8sLinkTargets(t *testing.T) {
+	// Recorded output of the readlink command of readK8sLinks, for a link to a name ending with a newline,
+	// a link with an empty target (readlink failed) and links to names with a leading dash and invalid UTF-8
+	output := "target\n\x00\x00-dash\x00../bad\xff\x00"
+	targets, err := parseK8sLinkTargets(output, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"target\n", "", "-dash", "../bad\xff"}
+	if !reflect.DeepEqual(targets, want) {
+		t.Errorf("got targets %q, want %q", targets, want)
+	}
+
+	for _, bad := range []string{"", "target", "a\x00b\x00c\x00", "a\x00b\x00c\x00d\x00e\x00"} {
+		if targets, err := parseK8sLinkTargets(bad, 4); err == nil {
+			t.Errorf("%q: expected an error, got %q", bad, targets)
+		}
+	}
+}
+
+func TestParseK8sEntriesNoSpaceSplit(t *testing.T) {
+	// Names are never split on spaces, only the attribute lines are
+	output := "1\n81a4 1 644 0 0 1792368850\n/data/a b  c\x00"
+	entries, err := parseK8sEntries(bytes.NewBufferString(output), "/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !strings.HasSuffix(entries[0].path, "a b  c") {
+		t.Errorf("unexpected entries: %+v", entries)
+	}
+}
+
+func TestUnescapeK8sPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"ns/pod/c/a%20b/c%2Fd", "ns/pod/c/a b/c/d"},
+		{"ns/-l app.kubernetes.io%2Fname=web/c/a%20b", "ns/-l app.kubernetes.io%2Fname=web/c/a b"},
+		{"ns/-l%20app.kubernetes.io%2Fname=web,tier%3Dfront/c/path", "ns/-l app.kubernetes.io%2Fname=web,tier=front/c/path"},
+		{"ctx@ns/-l=a%2Fb", "ctx@ns/-l=a%2Fb"},
+		{"ns/-l a%25b/c/p", "ns/-l a%25b/c/p"},
+		{"ns", "ns"},
+	}
+	for _, tt := range tests {
+		got, err := unescapeK8sPath(tt.path)
+		if err != nil {
+			t.Errorf("%s: %v", tt.path, err)
+		} else if got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.path, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"ns/-l a%/c/p", "ns/-l a/c/p%", "n%s/-l a/c/p"} {
+		if got, err := unescapeK8sPath(bad); err == nil {
+			t.Errorf("%s: expected an error, got %s", bad, got)
+		}
+	}
+}
+
+func TestGetK8sPodsEscapedSelector(t *testing.T) {
+	var selector string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		selector = r.URL.Query().Get("labelSelector")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"kind":"PodList","apiVersion":"v1","items":[` +
+			`{"metadata":{"name":"web-1"},"status":{"phase":"Running","conditions":[{"type":"Ready","status":"True"}]}}]}`))
+	}))
+	defer srv.Close()
+	clientSet, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := unescapeK8sPath("ns/-l app.kubernetes.io%2Fname=web/c/p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths, _, err := ExpandK8sPath(&K8sClient{ClientSet: clientSet}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selector != "app.kubernetes.io/name=web" {
+		t.Errorf("got label selector %q, want app.kubernetes.io/name=web", selector)
+	}
+	if want := []string{"ns/web-1/c/p"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("got paths %q, want %q", paths, want)
+	}
+}
+
+func TestK8sReplaceCommand(t *testing.T) {
+	if _, err := exec.LookPath("stat"); err != nil {
+		t.Skip("stat not found")
+	}
+	replace := func(tmpPath, path string, attrs bool) {
+		t.Helper()
+		command := k8sReplaceCommand(tmpPath, path, attrs)
+		if out, err := exec.Command(command[0], command[1:]...).CombinedOutput(); err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
+	}
+	check := func(path, data string, mode os.FileMode) {
+		t.Helper()
+		got, err := os.ReadFile(path)
+		if err != nil || string(got) != data {
+			t.Errorf("got %q %v, want %q", got, err, data)
+		}
+		if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != mode {
+			t.Errorf("got mode %v %v, want %v", fi.Mode(), err, mode)
+		}
+	}
+	dir := t.TempDir()
+	path, tmpPath := filepath.Join(dir, "file"), filepath.Join(dir, ".file.tmp")
+
+	for _, tt := range []struct {
+		name     string
+		existing bool
+		attrs    bool
+		want     os.FileMode
+	}{
+		{"new file", false, false, 0644},
+		{"keeps mode", true, false, 0600},
+		{"applied attributes", true, true, 0644},
+	} {
+		os.Remove(path)
+		if tt.existing {
+			if err := os.WriteFile(path, []byte("old"), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.WriteFile(tmpPath, []byte(tt.name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chmod(tmpPath, 0644)
+		replace(tmpPath, path, tt.attrs)
+		check(path, tt.name, tt.want)
+		if _, err := os.Stat(tmpPath); !os.IsNotExist(err) {
+			t.Errorf("%s: temporary file left: %v", tt.name, err)
+		}
+	}
+
+	// A file mounted by itself can not be renamed over, it is written in place
+	mounted := filepath.Join(dir, "mounted")
+	if err := os.WriteFile(mounted, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Command("mount", "--bind", path, mounted).Run(); err != nil {
+		t.Skipf("can not bind mount: %v", err)
+	}
+	defer exec.Command("umount", mounted).Run()
+	if err := os.WriteFile(tmpPath, []byte("in place"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(tmpPath, 0640)
+	replace(tmpPath, mounted, true)
+	check(path, "in place", 0640)
+	if _, err := os.Stat(tmpPath); !os.IsNotExist(err) {
+		t.Errorf("temporary file left: %v", err)
+	}
+}
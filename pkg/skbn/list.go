@@ -0,0 +1,129 @@
+package skbn
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/nuvo/skbn/pkg/utils"
+)
+
+// ListOptions holds the settings of a listing
+type ListOptions struct {
+	Recursive bool              // list the files in subdirectories, instead of the subdirectories
+	K8s       K8sClientOptions  // kubeconfig, context and identity for a Kubernetes path
+	Retry     utils.RetryPolicy // zero values are taken from utils.DefaultRetryPolicy
+}
+
+// List lists the files under a path, sorted by path.
+// Symbolic links and empty directories in Kubernetes are listed as well.
+// When the listing is not recursive, each subdirectory is listed once, with the total size
+// and the latest modification time of its files
+func List(path string, opts ListOptions) ([]FileInfo, error) {
+	client, prefix, path, err := openPath(path, opts.K8s, opts.Retry)
+	if err != nil {
+		return nil, err
+	}
+	defer closeClients(client)
+
+	files, err := getListOfFiles(client, prefix, path, listOptions{symlinks: SymlinksCopy, emptyDirs: true}, opts.Retry)
+	if err != nil {
+		return nil, err
+	}
+
+	if !opts.Recursive {
+		files = collapseSubdirectories(files)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].RelativePath < files[j].RelativePath
+	})
+
+	return files, nil
+}
+
+// openPath returns a client for a path of the form <prefix>://<path>, its prefix, and the path without the prefix.
+// Pod selectors in Kubernetes paths are resolved. The client must be closed with closeClients
+func openPath(path string, k8sOpts K8sClientOptions, retry utils.RetryPolicy) (interface{}, string, string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := ValidateExecTransport(k8sOpts.ExecTransport); err != nil {
+		return nil, "", "", err
+	}
+	prefix, path := utils.SplitInTwo(path, "://")
+	if err := TestImplementationsExist(prefix, prefix); err != nil {
+		return nil, "", "", err
+	}
+	path, err := unescapePath(prefix, path)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if prefix == "k8s" || prefix == "pvc" {
+		path, k8sOpts = SplitK8sContext(path, k8sOpts)
+	}
+
+	client, _, err := initClient(ctx, nil, prefix, path, "", k8sOpts, retry)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if prefix == "k8s" {
+		if path, err = ResolveK8sPath(client, path); err != nil {
+			closeClients(client)
+			return nil, "", "", err
+		}
+	}
+
+	return client, prefix, path, nil
+}
+
+// joinListedPath returns the path of a listed file from the listed path and the relative path of the file
+func joinListedPath(listed, relativePath string) string {
+	if relativePath == "" {
+		return listed
+	}
+	if listed == "" {
+		return strings.TrimPrefix(relativePath, "/")
+	}
+	return strings.TrimSuffix(listed, "/") + relativePath
+}
+
+// collapseSubdirectories replaces the files in each subdirectory with a single entry of the subdirectory
+func collapseSubdirectories(files []FileInfo) []FileInfo {
+	var collapsed []FileInfo
+	dirs := make(map[string]int)
+	for _, f := range files {
+		rel := strings.Trim(f.RelativePath, "/")
+		if rel == "" && f.IsDir {
+			// The listed directory itself is empty
+			continue
+		}
+		i := strings.Index(rel, "/")
+		if i < 0 && !f.IsDir {
+			collapsed = append(collapsed, f)
+			continue
+		}
+
+		// Empty directories are merged with the subdirectories of the same name, which S3 may list as well
+		name := "/" + rel
+		if i >= 0 {
+			name = "/" + rel[:i]
+		}
+		j, ok := dirs[name]
+		if !ok {
+			j = len(collapsed)
+			dirs[name] = j
+			collapsed = append(collapsed, FileInfo{RelativePath: name, IsDir: true})
+		}
+		d := &collapsed[j]
+		if f.Size > 0 && d.Size >= 0 {
+			d.Size += f.Size
+		} else if f.Size < 0 {
+			d.Size = -1
+		}
+		if f.ModTime.After(d.ModTime) {
+			d.ModTime = f.ModTime
+		}
+	}
+
+	return collapsed
+}
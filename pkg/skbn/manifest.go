@@ -0,0 +1,210 @@
+package skbn
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nuvo/skbn/pkg/utils"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Transfer is a single copy in a batch of copies
+type Transfer struct {
+	Src  string
+	Dst  string
+	Opts CopyOptions
+}
+
+// TransferReport is the outcome of a transfer in a batch of copies
+type TransferReport struct {
+	Src      string
+	Dst      string
+	Files    int64 // number of files copied
+	Bytes    int64 // total size of the files copied, not counting files of unknown size
+	Duration time.Duration
+	Err      error // nil if the transfer succeeded
+}
+
+// Manifest is a batch of transfers, read from a YAML file
+type Manifest struct {
+	Parallel  *int               `yaml:"parallel"` // number of files copied in parallel across all transfers
+	Transfers []ManifestTransfer `yaml:"transfers"`
+}
+
+// ManifestTransfer is a transfer in a manifest. Options which are not set are taken from the options of the batch
+type ManifestTransfer struct {
+	Src              string   `yaml:"src"`
+	Dst              string   `yaml:"dst"`
+	Parallel         *int     `yaml:"parallel"` // maximum number of files of this transfer copied in parallel
+	BufferSize       *float64 `yaml:"bufferSize"`
+	S3PartSize       *int64   `yaml:"s3PartSize"`
+	S3MaxUploadParts *int     `yaml:"s3MaxUploadParts"`
+	Journal          *string  `yaml:"journal"`
+	Resume           *bool    `yaml:"resume"`
+	FanOut           *bool    `yaml:"fanOut"`
+	SrcContext       *string  `yaml:"srcContext"`
+	DstContext       *string  `yaml:"dstContext"`
+	PreHook          *string  `yaml:"preHook"`
+	PostHook         *string  `yaml:"postHook"`
+	HookTarget       *string  `yaml:"hookTarget"`
+	Preserve         *bool    `yaml:"preserve"`
+	Symlinks         *string  `yaml:"symlinks"`
+	EmptyDirs        *bool    `yaml:"emptyDirs"`
+	NoMultiplex      *bool    `yaml:"noMultiplex"`
+	NoServerCopy     *bool    `yaml:"noServerCopy"`
+}
+
+// ReadManifest reads a manifest from a YAML file
+func ReadManifest(path string) (Manifest, error) {
+	var m Manifest
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return m, err
+	}
+	if err := yaml.UnmarshalStrict(data, &m); err != nil {
+		return m, fmt.Errorf("error reading manifest %s: %v", path, err)
+	}
+
+	if len(m.Transfers) == 0 {
+		return m, fmt.Errorf("manifest %s has no transfers", path)
+	}
+	for i, t := range m.Transfers {
+		if t.Src == "" || t.Dst == "" {
+			return m, fmt.Errorf("transfer %d in manifest %s: src and dst are required", i+1, path)
+		}
+		if t.Src == StdioPath || t.Dst == StdioPath {
+			return m, fmt.Errorf("transfer %d in manifest %s: can not copy from stdin or to stdout", i+1, path)
+		}
+	}
+	return m, nil
+}
+
+// Apply returns the transfers of the manifest, with the options they don't set taken from base.
+// The files of a transfer are copied with full parallelism, unless the transfer limits it,
+// and a transfer is journaled only if it sets its own journal
+func (m Manifest) Apply(base CopyOptions) []Transfer {
+	var transfers []Transfer
+	for _, t := range m.Transfers {
+		opts := base
+		opts.Parallel = 0
+		setInt(&opts.Parallel, t.Parallel)
+		if t.BufferSize != nil {
+			opts.BufferSize = *t.BufferSize
+		}
+		if t.S3PartSize != nil {
+			opts.S3PartSize = *t.S3PartSize
+		}
+		setInt(&opts.S3MaxUploadParts, t.S3MaxUploadParts)
+		// Transfers can not share a journal, so a journal is only set per transfer
+		opts.JournalPath = ""
+		setString(&opts.JournalPath, t.Journal)
+		if opts.JournalPath == "" {
+			opts.Resume = false
+		}
+		setBool(&opts.Resume, t.Resume)
+		setBool(&opts.FanOut, t.FanOut)
+		setString(&opts.SrcK8s.Context, t.SrcContext)
+		setString(&opts.DstK8s.Context, t.DstContext)
+		setString(&opts.PreHook, t.PreHook)
+		setString(&opts.PostHook, t.PostHook)
+		setString(&opts.HookTarget, t.HookTarget)
+		setBool(&opts.Preserve, t.Preserve)
+		setString(&opts.Symlinks, t.Symlinks)
+		setBool(&opts.EmptyDirs, t.EmptyDirs)
+		setBool(&opts.NoMultiplex, t.NoMultiplex)
+		setBool(&opts.NoServerCopy, t.NoServerCopy)
+
+		transfers = append(transfers, Transfer{Src: t.Src, Dst: t.Dst, Opts: opts})
+	}
+	return transfers
+}
+
+func setInt(dst *int, v *int) {
+	if v != nil {
+		*dst = *v
+	}
+}
+
+func setString(dst *string, v *string) {
+	if v != nil {
+		*dst = *v
+	}
+}
+
+func setBool(dst *bool, v *bool) {
+	if v != nil {
+		*dst = *v
+	}
+}
+
+// CopyMany runs transfers concurrently, with at most parallel files copied at a time across all transfers
+// (0 for full parallelism), and returns a report of each transfer.
+// A failed transfer does not stop the others. An error is returned if any transfer failed
+func CopyMany(transfers []Transfer, parallel int) ([]TransferReport, error) {
+	var budget *utils.BoundedWaitGroup
+	if parallel > 0 {
+		bwg := utils.NewBoundedWaitGroup(parallel)
+		budget = &bwg
+	}
+
+	reports := make([]TransferReport, len(transfers))
+	var wg sync.WaitGroup
+	for i, t := range transfers {
+		wg.Add(1)
+		go func(i int, t Transfer) {
+			defer wg.Done()
+			stats := &copyStats{}
+			opts := t.Opts
+			opts.budget, opts.stats = budget, stats
+
+			start := time.Now()
+			var err error
+			if opts.Move {
+				err = Move(t.Src, t.Dst, opts)
+			} else {
+				err = CopyWithOptions(t.Src, t.Dst, opts)
+			}
+			reports[i] = TransferReport{
+				Src:      t.Src,
+				Dst:      t.Dst,
+				Files:    stats.files.Load(),
+				Bytes:    stats.bytes.Load(),
+				Duration: time.Since(start),
+				Err:      err,
+			}
+		}(i, t)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, r := range reports {
+		if r.Err != nil {
+			failed++
+		}
+	}
+	if failed != 0 {
+		return reports, fmt.Errorf("%d of %d transfers failed", failed, len(transfers))
+	}
+	return reports, nil
+}
+
+// copyStats counts the files copied by a copy, and their size
+type copyStats struct {
+	files atomic.Int64
+	bytes atomic.Int64
+}
+
+// add counts a copied file of the given size (-1 if unknown). It does nothing on a nil copyStats
+func (s *copyStats) add(size int64) {
+	if s == nil {
+		return
+	}
+	s.files.Add(1)
+	if size > 0 {
+		s.bytes.Add(size)
+	}
+}
@@ -0,0 +1,119 @@
+package skbn
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeManifest(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "transfers.yaml")
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadManifest(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string // empty if the manifest is valid
+	}{
+		{"valid", "parallel: 4\ntransfers:\n  - src: k8s://ns/pod/c/data\n    dst: s3://bucket/data\n    parallel: 2\n", ""},
+		{"unknown field", "transfers:\n  - src: k8s://ns/pod/c/data\n    dst: s3://bucket/data\n    paralel: 2\n", "field paralel not found"},
+		{"unknown top level field", "transfer:\n  - src: a\n    dst: b\n", "field transfer not found"},
+		{"wrong type", "transfers:\n  - src: k8s://ns/pod/c/data\n    dst: s3://bucket/data\n    resume: maybe\n", "cannot unmarshal"},
+		{"duplicate field", "transfers:\n  - src: a\n    src: b\n    dst: c\n", "already set"},
+		{"not yaml", "transfers: [", "error reading manifest"},
+		{"no transfers", "parallel: 4\n", "has no transfers"},
+		{"no src", "transfers:\n  - dst: s3://bucket/data\n", "transfer 1 in manifest"},
+		{"no dst", "transfers:\n  - src: s3://bucket/a\n    dst: s3://bucket/b\n  - src: s3://bucket/c\n", "transfer 2 in manifest"},
+		{"stdio", "transfers:\n  - src: '-'\n    dst: s3://bucket/data\n", "can not copy from stdin"},
+	}
+	for _, tt := range tests {
+		m, err := ReadManifest(writeManifest(t, tt.data))
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			} else if len(m.Transfers) != 1 || *m.Parallel != 4 || *m.Transfers[0].Parallel != 2 {
+				t.Errorf("%s: unexpected manifest %+v", tt.name, m)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+
+	if _, err := ReadManifest(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("missing manifest: expected an error")
+	}
+}
+
+func TestManifestApply(t *testing.T) {
+	intp := func(i int) *int { return &i }
+	strp := func(s string) *string { return &s }
+	boolp := func(b bool) *bool { return &b }
+
+	base := CopyOptions{
+		Parallel:    8,
+		BufferSize:  6.75,
+		JournalPath: "/var/tmp/cli.journal",
+		Resume:      true,
+		Preserve:    true,
+		Symlinks:    SymlinksSkip,
+		Move:        true,
+		Verify:      VerifyChecksum,
+	}
+	base.SrcK8s.Context = "cli"
+
+	tests := []struct {
+		name     string
+		transfer ManifestTransfer
+		check    func(opts CopyOptions) bool
+	}{
+		{"parallel reset", ManifestTransfer{}, func(o CopyOptions) bool { return o.Parallel == 0 }},
+		{"parallel set", ManifestTransfer{Parallel: intp(2)}, func(o CopyOptions) bool { return o.Parallel == 2 }},
+		{"journal reset", ManifestTransfer{}, func(o CopyOptions) bool { return o.JournalPath == "" }},
+		{"resume cleared without a journal", ManifestTransfer{}, func(o CopyOptions) bool { return !o.Resume }},
+		{"resume set without a journal", ManifestTransfer{Resume: boolp(true)}, func(o CopyOptions) bool { return o.Resume && o.JournalPath == "" }},
+		{"journal kept resume", ManifestTransfer{Journal: strp("/var/tmp/a.journal")}, func(o CopyOptions) bool {
+			return o.JournalPath == "/var/tmp/a.journal" && o.Resume
+		}},
+		{"journal without resume", ManifestTransfer{Journal: strp("/var/tmp/a.journal"), Resume: boolp(false)}, func(o CopyOptions) bool {
+			return o.JournalPath == "/var/tmp/a.journal" && !o.Resume
+		}},
+		{"options inherited", ManifestTransfer{}, func(o CopyOptions) bool {
+			return o.BufferSize == 6.75 && o.Preserve && o.Symlinks == SymlinksSkip && o.Move && o.Verify == VerifyChecksum && o.SrcK8s.Context == "cli"
+		}},
+		{"options overridden", ManifestTransfer{Preserve: boolp(false), Symlinks: strp(SymlinksCopy), SrcContext: strp("prod"), DstContext: strp("dr")}, func(o CopyOptions) bool {
+			return !o.Preserve && o.Symlinks == SymlinksCopy && o.SrcK8s.Context == "prod" && o.DstK8s.Context == "dr"
+		}},
+	}
+	for _, tt := range tests {
+		tt.transfer.Src, tt.transfer.Dst = "k8s://ns/pod/c/data", "s3://bucket/data"
+		transfers := Manifest{Transfers: []ManifestTransfer{tt.transfer}}.Apply(base)
+		if len(transfers) != 1 {
+			t.Fatalf("%s: got %d transfers, want 1", tt.name, len(transfers))
+		}
+		if tr := transfers[0]; tr.Src != tt.transfer.Src || tr.Dst != tt.transfer.Dst || !tt.check(tr.Opts) {
+			t.Errorf("%s: unexpected transfer %+v", tt.name, tr)
+		}
+	}
+
+	// The options of a transfer don't leak into the next ones, nor into base
+	m := Manifest{Transfers: []ManifestTransfer{
+		{Src: "a", Dst: "b", Journal: strp("/var/tmp/a.journal"), Parallel: intp(3)},
+		{Src: "c", Dst: "d"},
+	}}
+	transfers := m.Apply(base)
+	if o := transfers[1].Opts; o.JournalPath != "" || o.Resume || o.Parallel != 0 {
+		t.Errorf("second transfer got journal %q, resume %v and parallel %d", o.JournalPath, o.Resume, o.Parallel)
+	}
+	if base.JournalPath != "/var/tmp/cli.journal" || base.Parallel != 8 {
+		t.Errorf("base changed: %+v", base)
+	}
+}
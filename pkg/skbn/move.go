@@ -0,0 +1,134 @@
+package skbn
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+
+	"github.com/nuvo/skbn/pkg/utils"
+)
+
+const (
+	// VerifySize verifies a moved file by comparing its size at the source and the destination
+	VerifySize = "size"
+	// VerifyChecksum verifies a moved file by comparing the SHA-256 checksum of the copied data
+	// with the checksum of the data read back from the destination
+	VerifyChecksum = "checksum"
+)
+
+// ValidateVerify returns an error if verify is not a known verification method
+func ValidateVerify(verify string) error {
+	switch verify {
+	case "", VerifySize, VerifyChecksum:
+		return nil
+	default:
+		return fmt.Errorf("unknown verification method %s, must be %s or %s", verify, VerifySize, VerifyChecksum)
+	}
+}
+
+// Move copies files from src to dst, and removes each source file once its copy is verified.
+// Directories are left in place in Kubernetes
+func Move(src, dst string, opts CopyOptions) error {
+	if src == dst {
+		return fmt.Errorf("%s and %s are the same path", src, dst)
+	}
+	// Files copied from a snapshot would be removed from the snapshot, not from the claim
+	if opts.SrcK8s.Snapshot.Enabled || opts.DstK8s.Snapshot.Enabled {
+		return fmt.Errorf("files can not be moved from a volume snapshot")
+	}
+	opts.Move = true
+	return CopyWithOptions(src, dst, opts)
+}
+
+// newVerifyHash returns the hash to compute over the copied data of a moved file, or nil if it is verified by size
+func newVerifyHash(opts CopyOptions) hash.Hash {
+	if !opts.Move || opts.Verify != VerifyChecksum {
+		return nil
+	}
+	return sha256.New()
+}
+
+// verifyCopy checks that a copied file landed at the destination.
+// sum is the hash of the copied data when the file is verified by checksum.
+// A file verified by size is verified by checksum if its size is unknown at the source or the destination
+func verifyCopy(srcClient, dstClient interface{}, srcPrefix, fromPath, dstPrefix, toPath string, size int64, sum hash.Hash, retry utils.RetryPolicy, verbose bool) error {
+	if sum != nil {
+		dstSum := sha256.New()
+		if err := download(dstClient, dstPrefix, toPath, dstSum, retry, verbose); err != nil {
+			return fmt.Errorf("error verifying %s://%s: %v", dstPrefix, toPath, err)
+		}
+		if !bytes.Equal(sum.Sum(nil), dstSum.Sum(nil)) {
+			return fmt.Errorf("checksum mismatch: %s://%s -> %s://%s", srcPrefix, fromPath, dstPrefix, toPath)
+		}
+		return nil
+	}
+
+	if size < 0 {
+		s, err := fileSize(srcClient, srcPrefix, fromPath, retry)
+		if err != nil {
+			return err
+		}
+		size = s
+	}
+	dstSize, err := fileSize(dstClient, dstPrefix, toPath, retry)
+	if err != nil {
+		return fmt.Errorf("error verifying %s://%s: %v", dstPrefix, toPath, err)
+	}
+	if size < 0 || dstSize < 0 {
+		sum := sha256.New()
+		if err := download(srcClient, srcPrefix, fromPath, sum, retry, verbose); err != nil {
+			return fmt.Errorf("error verifying %s://%s: %v", srcPrefix, fromPath, err)
+		}
+		return verifyCopy(srcClient, dstClient, srcPrefix, fromPath, dstPrefix, toPath, size, sum, retry, verbose)
+	}
+	if size != dstSize {
+		return fmt.Errorf("size mismatch: %s://%s (%d bytes) -> %s://%s (%d bytes)", srcPrefix, fromPath, size, dstPrefix, toPath, dstSize)
+	}
+	return nil
+}
+
+// fileSize returns the size of a single file, or -1 if it is unknown
+func fileSize(client interface{}, prefix, path string, retry utils.RetryPolicy) (int64, error) {
+	files, err := getListOfFiles(client, prefix, path, listOptions{}, retry)
+	if err != nil {
+		return 0, err
+	}
+	for _, f := range files {
+		if f.RelativePath == "" && !f.IsDir {
+			return f.Size, nil
+		}
+	}
+	return 0, fmt.Errorf("%s://%s: no such file", prefix, path)
+}
+
+// verifySpecial checks that an empty directory or a symbolic link was created at the destination, with the same target
+func verifySpecial(dstClient interface{}, dstPrefix, toPath string, ftp FromToPair, retry utils.RetryPolicy) error {
+	files, err := getListOfFiles(dstClient, dstPrefix, toPath, listOptions{symlinks: SymlinksCopy, emptyDirs: true}, retry)
+	if err != nil {
+		return fmt.Errorf("error verifying %s://%s: %v", dstPrefix, toPath, err)
+	}
+	for _, f := range files {
+		if ftp.IsDir {
+			// The directory may hold files copied to it since
+			return nil
+		}
+		if f.RelativePath != "" || f.IsDir {
+			continue
+		}
+		link, err := completeFromToPair(dstClient, dstPrefix, FromToPair{FromPath: toPath, Size: f.Size, LinkTarget: f.LinkTarget}, false)
+		if err != nil {
+			return fmt.Errorf("error verifying %s://%s: %v", dstPrefix, toPath, err)
+		}
+		if link.LinkTarget != ftp.LinkTarget {
+			return fmt.Errorf("symbolic link mismatch: %s://%s points to %q, not %q", dstPrefix, toPath, link.LinkTarget, ftp.LinkTarget)
+		}
+		return nil
+	}
+	return fmt.Errorf("error verifying %s://%s: no such file", dstPrefix, toPath)
+}
+
+// removeSource removes a single moved file, or symbolic link, from the source
+func removeSource(client interface{}, prefix, path string, retry utils.RetryPolicy) error {
+	return removeFiles(client, prefix, path, []FileInfo{{}}, false, 1, retry)
+}
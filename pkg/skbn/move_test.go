@@ -0,0 +1,71 @@
+package skbn
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/nuvo/skbn/pkg/utils"
+)
+
+// testS3Session returns a session of an S3 server holding empty objects with metadata, by key
+func testS3Session(t *testing.T, objects map[string]map[string]string) *session.Session {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/bucket":
+			fmt.Fprint(w, `<ListBucketResult><IsTruncated>false</IsTruncated>`)
+			for k := range objects {
+				if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+					fmt.Fprintf(w, `<Contents><Key>%s</Key><Size>0</Size></Contents>`, k)
+				}
+			}
+			fmt.Fprint(w, `</ListBucketResult>`)
+		case r.Method == http.MethodHead && objects[key] != nil:
+			for k, v := range objects[key] {
+				w.Header().Set("X-Amz-Meta-"+k, v)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return session.Must(session.NewSession(&aws.Config{
+		Endpoint:         aws.String(srv.URL),
+		Region:           aws.String("us-east-1"),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		S3ForcePathStyle: aws.Bool(true),
+	}))
+}
+
+func TestVerifySpecial(t *testing.T) {
+	s := testS3Session(t, map[string]map[string]string{
+		"link":       {"Skbnlink": "..%2Ftarget%20file"},
+		"dir/":       {},
+		"linked/sub": {"Skbnlink": "x"},
+	})
+	retry := utils.RetryPolicy{MaxAttempts: 1}
+	tests := []struct {
+		path string
+		ftp  FromToPair
+		ok   bool
+	}{
+		{"bucket/link", FromToPair{LinkTarget: "../target file"}, true},
+		{"bucket/link", FromToPair{LinkTarget: "other"}, false},
+		{"bucket/missing", FromToPair{LinkTarget: "../target file"}, false},
+		{"bucket/dir", FromToPair{IsDir: true}, true},
+		{"bucket/missing", FromToPair{IsDir: true}, false},
+		{"bucket/linked", FromToPair{LinkTarget: "x"}, false},
+	}
+	for _, tt := range tests {
+		err := verifySpecial(s, "s3", tt.path, tt.ftp, retry)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s %+v: got error %v, want ok %v", tt.path, tt.ftp, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package skbn
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nuvo/skbn/pkg/utils"
+
+	core_v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// A pvc:// path (<namespace>/<claimName>/<path>) is accessed through a short-lived helper pod mounting the claim.
+// The helper pod is created on first access, and deleted when the client is closed
+
+const (
+	// DefaultHelperImage is the image of helper pods when none is set
+	DefaultHelperImage = "busybox:stable"
+
+	helperPodContainer = "skbn"
+	helperPodMountPath = "/pvc"
+	helperPodTimeout   = 5 * time.Minute
+)
+
+// HelperPodOptions configures the helper pods skbn creates to access persistent volume claims
+type HelperPodOptions struct {
+	Image        string               // image with a shell and coreutils, empty for DefaultHelperImage
+	NodeAffinity map[string]string    // node labels the helper pod must be scheduled on
+	Tolerations  []core_v1.Toleration // tolerations of the helper pod
+}
+
+type helperPods struct {
+	mu       sync.Mutex
+	pods     map[helperPodKey]*helperPodEntry // the helper pod to use for each claim
+	created  []createdPod                     // all the helper pods created, deleted when the client is closed
+	restored []restoredClaim
+}
+
+type helperPodKey struct {
+	namespace string
+	claim     string
+	snapshot  bool // the pod mounts a claim restored from a snapshot of the claim
+}
+
+// helperPodEntry is a helper pod being created. ready is closed once the pod is ready or failed to get ready
+type helperPodEntry struct {
+	ready    chan struct{}
+	readOnly bool
+	name     string
+	node     string
+	err      error
+}
+
+type createdPod struct {
+	namespace string
+	name      string
+}
+
+// ParseToleration parses a toleration of the form <key>[=<value>]:<effect>, or <key>[=<value>] to tolerate all effects
+func ParseToleration(s string) (core_v1.Toleration, error) {
+	t := core_v1.Toleration{Operator: core_v1.TolerationOpExists}
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		t.Effect = core_v1.TaintEffect(s[i+1:])
+		s = s[:i]
+	}
+	if i := strings.Index(s, "="); i >= 0 {
+		t.Operator = core_v1.TolerationOpEqual
+		t.Value = s[i+1:]
+		s = s[:i]
+	}
+	t.Key = s
+
+	switch t.Effect {
+	case "", core_v1.TaintEffectNoSchedule, core_v1.TaintEffectPreferNoSchedule, core_v1.TaintEffectNoExecute:
+	default:
+		return t, fmt.Errorf("illegal toleration effect: %s", t.Effect)
+	}
+	if t.Key == "" && t.Operator == core_v1.TolerationOpEqual {
+		return t, fmt.Errorf("illegal toleration, a value requires a key")
+	}
+
+	return t, nil
+}
+
+func getListOfFilesFromPVC(iClient interface{}, path, findType, findName string, lo listOptions, retry utils.RetryPolicy) ([]FileInfo, error) {
+	client, k8sPath, err := pvcToK8sPath(iClient, path, !lo.readWrite)
+	if err != nil {
+		return nil, err
+	}
+	return getListOfFilesFromK8s(client, k8sPath, findType, findName, lo, retry)
+}
+
+func downloadFromPVC(iClient interface{}, path string, writer io.Writer, retry utils.RetryPolicy, verbose bool) error {
+	client, k8sPath, err := pvcToK8sPath(iClient, path, true)
+	if err != nil {
+		return err
+	}
+	return downloadFromK8s(client, k8sPath, writer, retry, verbose)
+}
+
+func uploadToPVC(iClient interface{}, toPath, fromPath string, reader io.Reader, attrs *FileAttrs, retry utils.RetryPolicy, verbose bool) error {
+	client, k8sPath, err := pvcToK8sPath(iClient, toPath, false)
+	if err != nil {
+		return err
+	}
+	return uploadToK8s(client, k8sPath, fromPath, reader, attrs, retry, verbose)
+}
+
+// pvcToK8sPath returns the path of a pvc:// path in its helper pod, creating the helper pod if needed,
+// and the client to access the helper pod with
+func pvcToK8sPath(iClient interface{}, path string, readOnly bool) (*K8sClient, string, error) {
+	client := *iClient.(*K8sClient)
+	pSplit := strings.Split(path, "/")
+	if len(pSplit) < 2 || pSplit[1] == "" {
+		return nil, "", fmt.Errorf("illegal path: %s", path)
+	}
+	namespace, claim := pSplit[0], pSplit[1]
+	if namespace == "" {
+		namespace = client.Namespace
+	}
+
+	podName, err := client.helperPod(namespace, claim, readOnly)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// The helper image has the binaries skbn needs, a debug container is never needed
+	client.DebugImage = ""
+	k8sPath := strings.Join(append([]string{namespace, podName, helperPodContainer, strings.TrimPrefix(helperPodMountPath, "/")}, pSplit[2:]...), "/")
+
+	return &client, k8sPath, nil
+}
+
+// helperPod returns the name of a ready helper pod mounting the claim, creating it if needed.
+// A read-write pod also serves read-only access. A read-write pod needed after a read-only pod
+// is created on the node of the read-only pod, so a ReadWriteOnce volume does not have to attach to another node
+func (client K8sClient) helperPod(namespace, claim string, readOnly bool) (string, error) {
+	if client.helpers == nil {
+		return "", fmt.Errorf("helper pods require a client from GetClientToK8sWithOptions")
+	}
+	helpers := client.helpers
+	snapshot := readOnly && client.Snapshot.Enabled
+	key := helperPodKey{namespace, claim, snapshot}
+
+	helpers.mu.Lock()
+	prev, ok := helpers.pods[key]
+	if ok && (readOnly || !prev.readOnly) {
+		helpers.mu.Unlock()
+		<-prev.ready
+		return prev.name, prev.err
+	}
+	// Other callers wait for the pod instead of creating their own
+	e := &helperPodEntry{ready: make(chan struct{}), readOnly: readOnly}
+	helpers.pods[key] = e
+	helpers.mu.Unlock()
+
+	var node string
+	if prev != nil {
+		<-prev.ready
+		node = prev.node
+	}
+	e.name, e.node, e.err = client.createHelperPod(namespace, claim, readOnly, snapshot, node)
+	if e.err != nil {
+		// Only ready pods are kept, a failed pod is never returned again
+		helpers.mu.Lock()
+		if prev != nil && prev.err == nil {
+			helpers.pods[key] = prev
+		} else {
+			delete(helpers.pods, key)
+		}
+		helpers.mu.Unlock()
+	}
+	close(e.ready)
+
+	return e.name, e.err
+}
+
+// createHelperPod creates a helper pod mounting the claim, or a claim restored from a snapshot of it, on node if it is set,
+// and returns the name of the pod and its node once it is ready
+func (client K8sClient) createHelperPod(namespace, claim string, readOnly, snapshot bool, node string) (string, string, error) {
+	if _, err := client.ClientSet.CoreV1().PersistentVolumeClaims(namespace).Get(context.Background(), claim, metav1.GetOptions{}); err != nil {
+		return "", "", fmt.Errorf("error getting persistent volume claim %s/%s: %v", namespace, claim, err)
+	}
+
+	mountClaim := claim
+	if snapshot {
+		restored, err := client.restoreSnapshot(namespace, claim)
+		if err != nil {
+			return "", "", err
+		}
+		mountClaim = restored
+	}
+
+	spec := newHelperPod(client.HelperPod, mountClaim, readOnly)
+	spec.Spec.NodeName = node
+	pod, err := client.ClientSet.CoreV1().Pods(namespace).Create(context.Background(), spec, metav1.CreateOptions{})
+	if err != nil {
+		return "", "", fmt.Errorf("error creating helper pod for persistent volume claim %s/%s: %v", namespace, claim, err)
+	}
+	// Recorded before it is ready, so it is deleted even if it never gets ready
+	client.helpers.mu.Lock()
+	client.helpers.created = append(client.helpers.created, createdPod{namespace, pod.Name})
+	client.helpers.mu.Unlock()
+
+	pod, err = waitForHelperPod(client, namespace, pod.Name)
+	if err != nil {
+		return "", "", fmt.Errorf("helper pod for persistent volume claim %s/%s: %v", namespace, claim, err)
+	}
+
+	return pod.Name, pod.Spec.NodeName, nil
+}
+
+// deleteHelperPods deletes all the helper pods created by the client
+func (client K8sClient) deleteHelperPods() error {
+	if client.helpers == nil {
+		return nil
+	}
+	client.helpers.mu.Lock()
+	defer client.helpers.mu.Unlock()
+
+	var lastErr error
+	gracePeriod := int64(0)
+	for _, p := range client.helpers.created {
+		err := client.ClientSet.CoreV1().Pods(p.namespace).Delete(context.Background(), p.name, metav1.DeleteOptions{GracePeriodSeconds: &gracePeriod})
+		if err != nil {
+			lastErr = fmt.Errorf("error deleting helper pod %s/%s: %v", p.namespace, p.name, err)
+		}
+	}
+	client.helpers.created = nil
+	client.helpers.pods = make(map[helperPodKey]*helperPodEntry)
+
+	return lastErr
+}
+
+func newHelperPod(opts HelperPodOptions, claim string, readOnly bool) *core_v1.Pod {
+	image := opts.Image
+	if image == "" {
+		image = DefaultHelperImage
+	}
+	gracePeriod := int64(0)
+
+	pod := &core_v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        fmt.Sprintf("skbn-pvc-%x", rand.Uint32()),
+			Labels:      map[string]string{"app": "skbn", "skbn/helper": "pvc"},
+			Annotations: map[string]string{"skbn/claim": claim},
+		},
+		Spec: core_v1.PodSpec{
+			RestartPolicy:                 core_v1.RestartPolicyNever,
+			TerminationGracePeriodSeconds: &gracePeriod,
+			Tolerations:                   opts.Tolerations,
+			Containers: []core_v1.Container{{
+				Name:    helperPodContainer,
+				Image:   image,
+				Command: []string{"sh", "-c", "trap 'exit 0' TERM; while true; do sleep 1; done"},
+				VolumeMounts: []core_v1.VolumeMount{{
+					Name:      "pvc",
+					MountPath: helperPodMountPath,
+					ReadOnly:  readOnly,
+				}},
+			}},
+			Volumes: []core_v1.Volume{{
+				Name: "pvc",
+				VolumeSource: core_v1.VolumeSource{
+					PersistentVolumeClaim: &core_v1.PersistentVolumeClaimVolumeSource{
+						ClaimName: claim,
+						ReadOnly:  readOnly,
+					},
+				},
+			}},
+		},
+	}
+
+	if len(opts.NodeAffinity) != 0 {
+		var expressions []core_v1.NodeSelectorRequirement
+		for k, v := range opts.NodeAffinity {
+			expressions = append(expressions, core_v1.NodeSelectorRequirement{
+				Key:      k,
+				Operator: core_v1.NodeSelectorOpIn,
+				Values:   []string{v},
+			})
+		}
+		pod.Spec.Affinity = &core_v1.Affinity{
+			NodeAffinity: &core_v1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &core_v1.NodeSelector{
+					NodeSelectorTerms: []core_v1.NodeSelectorTerm{{MatchExpressions: expressions}},
+				},
+			},
+		}
+	}
+
+	return pod
+}
+
+// waitForHelperPod waits for a helper pod to be ready, and returns it
+func waitForHelperPod(client K8sClient, namespace, name string) (*core_v1.Pod, error) {
+	deadline := time.Now().Add(helperPodTimeout)
+	var reason string
+	for time.Now().Before(deadline) {
+		pod, err := client.ClientSet.CoreV1().Pods(namespace).Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if isK8sPodReady(pod) {
+			return pod, nil
+		}
+		if pod.Status.Phase == core_v1.PodFailed || pod.Status.Phase == core_v1.PodSucceeded {
+			return nil, fmt.Errorf("pod %s terminated: %s", name, pod.Status.Reason)
+		}
+
+		for _, c := range pod.Status.Conditions {
+			if c.Type == core_v1.PodScheduled && c.Status == core_v1.ConditionFalse && c.Message != "" {
+				reason = c.Message
+			}
+		}
+		for _, s := range pod.Status.ContainerStatuses {
+			if w := s.State.Waiting; w != nil {
+				switch w.Reason {
+				case "ErrImagePull", "ImagePullBackOff", "InvalidImageName":
+					return nil, fmt.Errorf("pod %s can not start: %s", name, w.Message)
+				case "ContainerCreating":
+				default:
+					reason = w.Reason
+				}
+			}
+		}
+
+		time.Sleep(time.Second)
+	}
+
+	if reason != "" {
+		return nil, fmt.Errorf("timed out waiting for pod %s: %s", name, reason)
+	}
+	return nil, fmt.Errorf("timed out waiting for pod %s, check its events for volume attachment errors", name)
+}
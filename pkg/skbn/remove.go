@@ -0,0 +1,323 @@
+package skbn
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/nuvo/skbn/pkg/utils"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// removeK8sBatch is the number of files removed by a single command
+	removeK8sBatch = 200
+	// removeS3Batch is the maximum number of objects in a DeleteObjects request
+	removeS3Batch = 1000
+)
+
+// RemoveOptions holds the settings of a removal
+type RemoveOptions struct {
+	Recursive bool     // remove the files under a directory (or prefix)
+	Include   []string // remove only the files matching one of these patterns, all files if empty
+	Exclude   []string // keep the files matching one of these patterns
+	DryRun    bool     // list the files that would be removed, without removing them
+	// Confirm is called with the files to remove before they are removed, and the removal is aborted if it returns false.
+	// Nil to remove without confirmation
+	Confirm  func(files []FileInfo) bool
+	Parallel int               // number of Azure blobs removed in parallel, 0 for full parallelism
+	K8s      K8sClientOptions  // kubeconfig, context and identity for a Kubernetes path
+	Retry    utils.RetryPolicy // zero values are taken from utils.DefaultRetryPolicy
+}
+
+// Remove removes the file at a path, or the files under it when opts.Recursive is set,
+// and returns the removed files (the files that would be removed in a dry run).
+// Patterns are matched (as by path.Match) against the path of a file relative to the removed path, and against its name.
+// In Kubernetes, only the listed files are removed, and when no patterns are set, the directories left empty
+func Remove(path string, opts RemoveOptions) ([]FileInfo, error) {
+	for _, patterns := range [][]string{opts.Include, opts.Exclude} {
+		for _, pattern := range patterns {
+			if err := ValidatePattern(pattern); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	client, prefix, path, err := openPath(path, opts.K8s, opts.Retry)
+	if err != nil {
+		return nil, err
+	}
+	defer closeClients(client)
+
+	// The files of a claim are removed in the read-write helper pod, which lists them as well
+	files, err := getListOfFiles(client, prefix, path, listOptions{symlinks: SymlinksCopy, emptyDirs: true, readWrite: !opts.DryRun}, opts.Retry)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s://%s: no such file or directory", prefix, path)
+	}
+	single := len(files) == 1 && files[0].RelativePath == "" && !files[0].IsDir
+	if !single && !opts.Recursive {
+		return nil, fmt.Errorf("%s://%s is a directory, remove it recursively", prefix, path)
+	}
+
+	files = filterFiles(files, path, opts.Include, opts.Exclude)
+	if opts.DryRun || len(files) == 0 {
+		return files, nil
+	}
+	if opts.Confirm != nil && !opts.Confirm(files) {
+		return nil, fmt.Errorf("removal of %s://%s not confirmed", prefix, path)
+	}
+
+	all := len(opts.Include) == 0 && len(opts.Exclude) == 0
+	if err := removeFiles(client, prefix, path, files, all, opts.Parallel, opts.Retry); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// ValidatePattern returns an error if pattern is not a valid file name pattern
+func ValidatePattern(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("illegal pattern %s: %v", pattern, err)
+	}
+	return nil
+}
+
+// filterFiles returns the files matching one of include (or all files if include is empty), and none of exclude
+func filterFiles(files []FileInfo, listed string, include, exclude []string) []FileInfo {
+	if len(include) == 0 && len(exclude) == 0 {
+		return files
+	}
+	var filtered []FileInfo
+	for _, f := range files {
+		name := strings.Trim(f.RelativePath, "/")
+		if name == "" {
+			name = path.Base(listed)
+		}
+		if (len(include) == 0 || matchesAny(include, name)) && !matchesAny(exclude, name) {
+			filtered = append(filtered, f)
+		}
+	}
+	return filtered
+}
+
+// matchesAny returns true if the relative path name, or its last element, matches one of patterns
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// removeFiles removes listed files under a path. If all is set, all the files under the path were listed
+func removeFiles(client interface{}, prefix, listed string, files []FileInfo, all bool, parallel int, retry utils.RetryPolicy) error {
+	switch prefix {
+	case "k8s":
+		return removeFromK8s(client, listed, files, all, retry)
+	case "pvc":
+		k8sClient, k8sPath, err := pvcToK8sPath(client, listed, false)
+		if err != nil {
+			return err
+		}
+		return removeFromK8s(k8sClient, k8sPath, files, all, retry)
+	case "s3":
+		return removeFromS3(client, listed, files, retry)
+	case "abs":
+		return removeFromAbs(client, listed, files, parallel)
+	default:
+		return fmt.Errorf("%s not implemented", prefix)
+	}
+}
+
+// removeFromK8s removes files in a container in batches. If all is set, the directories left empty are removed too,
+// while directories still holding files which were not listed (such as sockets) are kept
+func removeFromK8s(iClient interface{}, listed string, files []FileInfo, all bool, retry utils.RetryPolicy) error {
+	client := *iClient.(*K8sClient)
+	pSplit := strings.Split(listed, "/")
+	if err := validateK8sPath(pSplit); err != nil {
+		return err
+	}
+	namespace, podName, containerName, pathToRemove := initK8sVariables(pSplit)
+	execContainer, root, err := client.execTarget(namespace, podName, containerName)
+	if err != nil {
+		return err
+	}
+	if all && pathToRemove == "/" {
+		return fmt.Errorf("refusing to remove / in %s/%s/%s", namespace, podName, containerName)
+	}
+
+	for _, batch := range k8sRemoveBatches(root, pathToRemove, files, all) {
+		for start := 0; start < len(batch.paths); start += removeK8sBatch {
+			end := start + removeK8sBatch
+			if end > len(batch.paths) {
+				end = len(batch.paths)
+			}
+			command := append(batch.command, batch.paths[start:end]...)
+
+			err := retry.Do(func(attempt int) error {
+				stderr, err := Exec(client, namespace, podName, execContainer, command, nil, nil)
+				if len(stderr) != 0 {
+					return k8sStderrError(stderr)
+				}
+				return k8sRetryable(err)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// k8sRemoveBatch is a command run with paths appended to it, in batches
+type k8sRemoveBatch struct {
+	command []string
+	paths   []string
+}
+
+// k8sRemoveBatches returns the commands removing files listed under pathToRemove, in the order they run:
+// the files, the listed directories (which are empty), and if all is set, the parent directories, deepest first.
+// A parent directory still holding files is kept
+func k8sRemoveBatches(root, pathToRemove string, files []FileInfo, all bool) []k8sRemoveBatch {
+	var paths, dirs []string
+	parents := make(map[string]bool)
+	for _, f := range files {
+		p := joinListedPath(pathToRemove, strings.TrimSuffix(f.RelativePath, "/"))
+		if f.IsDir {
+			dirs = append(dirs, root+p)
+		} else {
+			paths = append(paths, root+p)
+		}
+		for all && p != pathToRemove && p != "/" {
+			p = path.Dir(p)
+			parents[root+p] = true
+		}
+	}
+	// Listed directories are empty, and parents are removed after their subdirectories
+	var emptied []string
+	for p := range parents {
+		emptied = append(emptied, p)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(emptied)))
+
+	return []k8sRemoveBatch{
+		{[]string{"rm", "-f", "--"}, paths},
+		{[]string{"rmdir", "--"}, dirs},
+		{[]string{"sh", "-c", `for d; do rmdir -- "$d" 2>/dev/null; done; exit 0`, "sh"}, emptied},
+	}
+}
+
+// removeFromS3 removes objects in batches. Only the objects that failed to be removed are retried
+func removeFromS3(iClient interface{}, listed string, files []FileInfo, retry utils.RetryPolicy) error {
+	s := iClient.(*session.Session)
+	pSplit := strings.Split(listed, "/")
+	if err := validateS3Path(pSplit); err != nil {
+		return err
+	}
+	bucket, s3Path := initS3Variables(pSplit)
+	svc := s3.New(s)
+
+	for start := 0; start < len(files); start += removeS3Batch {
+		end := start + removeS3Batch
+		if end > len(files) {
+			end = len(files)
+		}
+		var objects []*s3.ObjectIdentifier
+		for _, f := range files[start:end] {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(joinListedPath(s3Path, f.RelativePath))})
+		}
+
+		err := retry.Do(func(attempt int) error {
+			out, err := svc.DeleteObjects(&s3.DeleteObjectsInput{
+				Bucket: aws.String(bucket),
+				Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+			})
+			if err != nil {
+				return s3Retryable(err)
+			}
+			if len(out.Errors) == 0 {
+				return nil
+			}
+
+			objects = nil
+			permanent := true
+			for _, e := range out.Errors {
+				objects = append(objects, &s3.ObjectIdentifier{Key: e.Key, VersionId: e.VersionId})
+				if aws.StringValue(e.Code) != "AccessDenied" {
+					permanent = false
+				}
+			}
+			e := out.Errors[0]
+			err = fmt.Errorf("error removing %d objects, %s: %s: %s", len(out.Errors), aws.StringValue(e.Key), aws.StringValue(e.Code), aws.StringValue(e.Message))
+			if permanent {
+				return utils.Permanent(err)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeFromAbs removes blobs in parallel, with their snapshots.
+// The blob batch API is not available in the SDK, so each blob is removed by its own request.
+// Requests are retried by the pipeline of the client
+func removeFromAbs(iClient interface{}, listed string, files []FileInfo, parallel int) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pSplit := strings.Split(listed, "/")
+	if err := validateAbsPath(pSplit); err != nil {
+		return err
+	}
+	a, c, p := initAbsVariables(pSplit)
+	cu, err := getContainerURL(iClient.(pipeline.Pipeline), a, c)
+	if err != nil {
+		return err
+	}
+
+	if parallel == 0 || parallel > len(files) {
+		parallel = len(files)
+	}
+	bwg := utils.NewBoundedWaitGroup(parallel)
+	errc := make(chan error, 1)
+	for _, f := range files {
+		if len(errc) != 0 {
+			break
+		}
+		bwg.Add(1)
+		go func(name string) {
+			defer bwg.Done()
+			_, err := getBlobURL(cu, name).Delete(ctx, azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{})
+			if err != nil {
+				select {
+				case errc <- fmt.Errorf("error removing %s: %v", name, err):
+				default:
+				}
+			}
+		}(joinListedPath(p, f.RelativePath))
+	}
+	bwg.Wait()
+
+	if len(errc) != 0 {
+		return <-errc
+	}
+	return nil
+}
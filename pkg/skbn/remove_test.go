@@ -0,0 +1,153 @@
+package skbn
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMatchesAny(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		name     string
+		want     bool
+	}{
+		{[]string{"*.log"}, "app.log", true},
+		{[]string{"*.log"}, "logs/app.log", true},
+		{[]string{"*.log"}, "app.log/data", false},
+		{[]string{"logs/*.log"}, "logs/app.log", true},
+		{[]string{"logs/*.log"}, "old/logs/app.log", false},
+		{[]string{"*"}, "a/b/c", true},
+		{[]string{"a/*"}, "a/b/c", false},
+		{[]string{"*.tmp", "cache"}, "x/cache", true},
+		{[]string{"["}, "[", false},
+		{nil, "a", false},
+	}
+	for _, tt := range tests {
+		if got := matchesAny(tt.patterns, tt.name); got != tt.want {
+			t.Errorf("%q %s: got %v, want %v", tt.patterns, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFilterFiles(t *testing.T) {
+	files := []FileInfo{
+		{RelativePath: "/app.log"},
+		{RelativePath: "/data/db.sqlite"},
+		{RelativePath: "/data/db.sqlite-wal"},
+		{RelativePath: "/logs/old.log"},
+		{RelativePath: "/logs/keep/"},
+	}
+	names := func(files []FileInfo) []string {
+		var names []string
+		for _, f := range files {
+			names = append(names, f.RelativePath)
+		}
+		return names
+	}
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		want    []string
+	}{
+		{"none", nil, nil, names(files)},
+		{"include base name", []string{"*.log"}, nil, []string{"/app.log", "/logs/old.log"}},
+		{"include relative path", []string{"data/*"}, nil, []string{"/data/db.sqlite", "/data/db.sqlite-wal"}},
+		{"exclude", nil, []string{"*.log"}, []string{"/data/db.sqlite", "/data/db.sqlite-wal", "/logs/keep/"}},
+		{"exclude wins over include", []string{"*.log", "db.*"}, []string{"logs/*", "*-wal"}, []string{"/app.log", "/data/db.sqlite"}},
+		{"directory by name", []string{"keep"}, nil, []string{"/logs/keep/"}},
+		{"nothing", []string{"*.txt"}, nil, nil},
+	}
+	for _, tt := range tests {
+		if got := names(filterFiles(files, "k8s://ns/pod/c/var", tt.include, tt.exclude)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// A single listed file has no relative path, it is matched by the base name of the listed path
+	single := []FileInfo{{RelativePath: ""}}
+	if got := filterFiles(single, "ns/pod/c/var/app.log", []string{"*.log"}, nil); len(got) != 1 {
+		t.Errorf("single file: got %d files, want 1", len(got))
+	}
+	if got := filterFiles(single, "ns/pod/c/var/app.log", nil, []string{"app.*"}); len(got) != 0 {
+		t.Errorf("single excluded file: got %d files, want 0", len(got))
+	}
+}
+
+func TestK8sRemoveBatchesOrder(t *testing.T) {
+	files := []FileInfo{
+		{RelativePath: "/a"},
+		{RelativePath: "/sub/deep/b"},
+		{RelativePath: "/sub/c"},
+		{RelativePath: "/empty/", IsDir: true},
+	}
+	batches := k8sRemoveBatches("/root", "/data", files, true)
+	if len(batches) != 3 {
+		t.Fatalf("got %d batches, want 3", len(batches))
+	}
+	if want := []string{"/root/data/a", "/root/data/sub/deep/b", "/root/data/sub/c"}; !reflect.DeepEqual(batches[0].paths, want) {
+		t.Errorf("got files %q, want %q", batches[0].paths, want)
+	}
+	if want := []string{"/root/data/empty"}; !reflect.DeepEqual(batches[1].paths, want) {
+		t.Errorf("got directories %q, want %q", batches[1].paths, want)
+	}
+	// Subdirectories are emptied before their parents
+	if want := []string{"/root/data/sub/deep", "/root/data/sub", "/root/data"}; !reflect.DeepEqual(batches[2].paths, want) {
+		t.Errorf("got emptied directories %q, want %q", batches[2].paths, want)
+	}
+
+	if batches := k8sRemoveBatches("", "/data", files, false); len(batches[2].paths) != 0 {
+		t.Errorf("got emptied directories %q without all, want none", batches[2].paths)
+	}
+}
+
+func TestK8sRemoveBatchesKeepsUnlisted(t *testing.T) {
+	for _, name := range []string{"sh", "rm", "rmdir"} {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("%s not found", name)
+		}
+	}
+	root := t.TempDir()
+	for _, p := range []string{"data/a", "data/sub/deep/b", "data/keep/listed", "data/keep/unlisted.sock", "data/keep/deeper/unlisted"} {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(p)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, p), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(root, "data", "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := []FileInfo{
+		{RelativePath: "/a"},
+		{RelativePath: "/sub/deep/b"},
+		{RelativePath: "/keep/listed"},
+		{RelativePath: "/empty/", IsDir: true},
+	}
+
+	for _, batch := range k8sRemoveBatches(root, "/data", files, true) {
+		if len(batch.paths) == 0 {
+			continue
+		}
+		command := append(batch.command, batch.paths...)
+		if out, err := exec.Command(command[0], command[1:]...).CombinedOutput(); err != nil {
+			t.Fatalf("%q: %v: %s", command, err, out)
+		}
+	}
+
+	for _, p := range []string{"data/a", "data/sub", "data/empty", "data/keep/listed"} {
+		if _, err := os.Lstat(filepath.Join(root, p)); !os.IsNotExist(err) {
+			t.Errorf("%s not removed: %v", p, err)
+		}
+	}
+	// Directories holding files which were not listed are kept, with the files
+	for _, p := range []string{"data/keep/unlisted.sock", "data/keep/deeper/unlisted"} {
+		if _, err := os.Lstat(filepath.Join(root, p)); err != nil {
+			t.Errorf("%s removed: %v", p, err)
+		}
+	}
+}
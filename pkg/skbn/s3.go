@@ -1,17 +1,23 @@
 package skbn
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/nuvo/skbn/pkg/utils"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
@@ -19,42 +25,42 @@ import (
 
 // GetClientToS3 checks the connection to S3 and returns the tested client
 func GetClientToS3(path string) (*session.Session, error) {
+	return getClientToS3(path, utils.DefaultRetryPolicy())
+}
+
+func getClientToS3(path string, retry utils.RetryPolicy) (*session.Session, error) {
 	pSplit := strings.Split(path, "/")
 	bucket, _ := initS3Variables(pSplit)
-	attempts := 3
-	attempt := 0
-	for attempt < attempts {
-		attempt++
 
-		s, err := getNewSession()
+	var s *session.Session
+	err := retry.Do(func(attempt int) error {
+		var err error
+		s, err = getNewSession()
 		if err != nil {
-			if attempt == attempts {
-				return nil, err
-			}
-			utils.Sleep(attempt)
-			continue
+			return err
 		}
 
 		_, err = s3.New(s).ListObjects(&s3.ListObjectsInput{
 			Bucket:  aws.String(bucket),
 			MaxKeys: aws.Int64(0),
 		})
-		if attempt == attempts {
-			if err != nil {
-				return nil, err
-			}
-		}
-		if err == nil {
-			return s, nil
-		}
-		utils.Sleep(attempt)
+		return s3Retryable(err)
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, nil
+	return s, nil
 }
 
 // GetListOfFilesFromS3 gets list of files in path from S3 (recursive)
 func GetListOfFilesFromS3(iClient interface{}, path string) ([]string, error) {
+	files, err := getListOfFilesFromS3(iClient, path)
+	return relativePaths(files), err
+}
+
+// getListOfFilesFromS3 lists the objects in path with their size and modification time
+func getListOfFilesFromS3(iClient interface{}, path string) ([]FileInfo, error) {
 	s := iClient.(*session.Session)
 	pSplit := strings.Split(path, "/")
 	if err := validateS3Path(pSplit); err != nil {
@@ -62,14 +68,24 @@ func GetListOfFilesFromS3(iClient interface{}, path string) ([]string, error) {
 	}
 	bucket, s3Path := initS3Variables(pSplit)
 
-	var outLines []string
+	var outLines []FileInfo
 	err := s3.New(s).ListObjectsPages(&s3.ListObjectsInput{
 		Bucket: aws.String(bucket),
 		Prefix: aws.String(s3Path),
 	}, func(p *s3.ListObjectsOutput, last bool) (shouldContinue bool) {
 		for _, obj := range p.Contents {
 			line := *obj.Key
-			outLines = append(outLines, strings.Replace(line, s3Path, "", 1))
+			// The listing prefix matches partial names as well, dir matches dirty/file
+			rel, ok := utils.TrimPathPrefix(line, s3Path)
+			if !ok {
+				continue
+			}
+			outLines = append(outLines, FileInfo{
+				RelativePath: rel,
+				Size:         aws.Int64Value(obj.Size),
+				IsDir:        strings.HasSuffix(line, "/") && aws.Int64Value(obj.Size) == 0,
+				ModTime:      aws.TimeValue(obj.LastModified),
+			})
 		}
 		return true
 	})
@@ -82,6 +98,10 @@ func GetListOfFilesFromS3(iClient interface{}, path string) ([]string, error) {
 
 // DownloadFromS3 downloads a single file from S3
 func DownloadFromS3(iClient interface{}, path string, writer io.Writer, verbose bool) error {
+	return downloadFromS3(iClient, path, writer, utils.DefaultRetryPolicy(), verbose)
+}
+
+func downloadFromS3(iClient interface{}, path string, writer io.Writer, retry utils.RetryPolicy, verbose bool) error {
 	s := iClient.(*session.Session)
 	pSplit := strings.Split(path, "/")
 	if err := validateS3Path(pSplit); err != nil {
@@ -91,12 +111,9 @@ func DownloadFromS3(iClient interface{}, path string, writer io.Writer, verbose
 		return err
 	}
 	bucket, s3Path := initS3Variables(pSplit)
+	cw := &countingWriter{writer: writer}
 
-	attempts := 3
-	attempt := 0
-	for attempt < attempts {
-		attempt++
-
+	return retry.Do(func(attempt int) error {
 		if verbose {
 			log.Printf("Attempt %d to download file from s3://%s/%s", attempt, bucket, s3Path)
 		}
@@ -104,33 +121,23 @@ func DownloadFromS3(iClient interface{}, path string, writer io.Writer, verbose
 		downloader := s3manager.NewDownloader(s)
 		downloader.Concurrency = 1 // support writerWrapper
 
-		_, err := downloader.Download(writerWrapper{writer},
+		_, err := downloader.Download(writerWrapper{cw},
 			&s3.GetObjectInput{
 				Bucket: aws.String(bucket),
 				Key:    aws.String(s3Path),
 			})
-
-		if verbose {
-			log.Printf("Downloaded file from s3://%s/%s", bucket, s3Path)
-		}
 		if err != nil {
 			if verbose {
 				log.Printf("Error: %v", err)
-				log.Printf("Attempt: %v", attempt)
-			}
-			if attempt == attempts {
-				if verbose {
-					log.Printf("This was last attempt")
-				}
-				return err
 			}
-			utils.Sleep(attempt)
-			continue
+			return streamRetryable(s3Retryable(err), cw.n)
 		}
-		return nil
-	}
 
-	return nil
+		if verbose {
+			log.Printf("Downloaded file from s3://%s/%s", bucket, s3Path)
+		}
+		return nil
+	})
 }
 
 type writerWrapper struct {
@@ -142,7 +149,13 @@ func (ww writerWrapper) WriteAt(p []byte, off int64) (n int, err error) {
 }
 
 // UploadToS3 uploads a single file to S3
+// If s3partSize is 0, the part size grows as the upload progresses
 func UploadToS3(iClient interface{}, toPath, fromPath string, reader io.Reader, s3partSize int64, s3maxUploadParts int, verbose bool) error {
+	return uploadToS3(iClient, toPath, fromPath, reader, -1, nil, s3partSize, s3maxUploadParts, nil, utils.DefaultRetryPolicy(), verbose)
+}
+
+// uploadToS3 uploads a single file to S3, with attrs stored as object metadata if they are not nil
+func uploadToS3(iClient interface{}, toPath, fromPath string, reader io.Reader, size int64, attrs *FileAttrs, s3partSize int64, s3maxUploadParts int, journal *Journal, retry utils.RetryPolicy, verbose bool) error {
 	s := iClient.(*session.Session)
 	pSplit := strings.Split(toPath, "/")
 	if err := validateS3Path(pSplit); err != nil {
@@ -157,58 +170,369 @@ func UploadToS3(iClient interface{}, toPath, fromPath string, reader io.Reader,
 	}
 	bucket, s3Path := initS3Variables(pSplit)
 
-	attempts := 3
-	attempt := 0
-	for attempt < attempts {
-		attempt++
+	partSize := s3partSize
+	if partSize == 0 && size >= 0 {
+		partSize = calculatePartSize(size, s3maxUploadParts)
+	}
+
+	cr := &countingReader{reader: reader}
+	metadata := aws.StringMap(attrs.metadata())
 
+	return retry.Do(func(attempt int) error {
 		if verbose {
 			log.Printf("Attempt %d to upload file to s3://%s/%s", attempt, bucket, s3Path)
 		}
 
-		// uploader := s3manager.NewUploader(s)
-		uploader := s3manager.NewUploader(s, func(u *s3manager.Uploader) {
-			u.PartSize = s3partSize
-			u.MaxUploadParts = s3maxUploadParts
-		})
+		var err error
+		// Files smaller than a part can't be resumed, and are uploaded with small parts to keep small buffers
+		if partSize == 0 || (journal != nil && (size < 0 || size > partSize)) {
+			if verbose && partSize == 0 {
+				log.Printf("Size of s3://%s/%s is unknown, part size will grow as needed", bucket, s3Path)
+			}
+			err = uploadToS3Multipart(s, bucket, s3Path, toPath, cr, partSize, s3maxUploadParts, metadata, journal, verbose)
+		} else {
+			uploaderPartSize := partSize
+			if 0 <= size && size < partSize {
+				uploaderPartSize = s3manager.DefaultUploadPartSize
+			}
+			uploader := s3manager.NewUploader(s, func(u *s3manager.Uploader) {
+				u.PartSize = uploaderPartSize
+				u.MaxUploadParts = s3maxUploadParts
+			})
 
-		_, err := uploader.Upload(&s3manager.UploadInput{
-			Bucket: aws.String(bucket),
-			Key:    aws.String(s3Path),
-			Body:   reader,
-		})
+			_, err = uploader.Upload(&s3manager.UploadInput{
+				Bucket:   aws.String(bucket),
+				Key:      aws.String(s3Path),
+				Body:     cr,
+				Metadata: metadata,
+			})
+		}
+		if err != nil {
+			if verbose {
+				log.Printf("Error: %v", err)
+			}
+			return streamRetryable(s3Retryable(err), cr.n)
+		}
 
 		if verbose {
 			log.Printf("Uploaded file to s3://%s/%s", bucket, s3Path)
 		}
-		if err != nil {
+		return nil
+	})
+}
+
+// getS3FileAttrs returns the attributes and the symbolic link target stored in the metadata of an object
+func getS3FileAttrs(iClient interface{}, path string) (*FileAttrs, string, error) {
+	s := iClient.(*session.Session)
+	pSplit := strings.Split(path, "/")
+	if err := validateS3Path(pSplit); err != nil {
+		return nil, "", err
+	}
+	bucket, s3Path := initS3Variables(pSplit)
+
+	head, err := s3.New(s).HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(s3Path),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	metadata := aws.StringValueMap(head.Metadata)
+	return attrsFromMetadata(metadata), linkFromMetadata(metadata), nil
+}
+
+// s3Retryable marks errors that retrying will not fix as permanent
+func s3Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		switch reqErr.StatusCode() {
+		case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+			return utils.Permanent(err)
+		}
+	}
+	var aErr awserr.Error
+	if errors.As(err, &aErr) {
+		switch aErr.Code() {
+		case s3.ErrCodeNoSuchBucket, s3.ErrCodeNoSuchKey, s3.ErrCodeNoSuchUpload, "AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch", "NoCredentialProviders":
+			return utils.Permanent(err)
+		}
+	}
+	return err
+}
+
+const (
+	s3MinPartSize     = 5 * 1024 * 1024        // 5 MB, the minimal size of a part S3 accepts
+	s3MaxPartSize     = 5 * 1024 * 1024 * 1024 // 5 GB, the maximal size of a part S3 accepts
+	s3DefaultPartSize = 128 * 1024 * 1024      // 128 MB, the minimal calculated part size
+)
+
+// calculatePartSize calculates an appropriate part size for the multipart upload.
+// The part size is at least 128MB, so large files don't need thousands of requests
+func calculatePartSize(fileSize int64, maxParts int) int64 {
+	if maxParts <= 0 {
+		maxParts = s3manager.MaxUploadParts
+	}
+	partSize := fileSize / int64(maxParts)
+	if fileSize%int64(maxParts) != 0 {
+		partSize++
+	}
+	if partSize < s3DefaultPartSize {
+		partSize = s3DefaultPartSize
+	}
+	if partSize > s3MaxPartSize {
+		partSize = s3MaxPartSize
+	}
+	return partSize
+}
+
+// adaptivePartSize returns the size of a part in an upload of unknown size.
+// The part size starts at 128MB and doubles every tenth of maxParts,
+// so 10000 parts are enough for objects up to the maximal object size of 5TB
+func adaptivePartSize(partNumber, maxParts int) int64 {
+	if maxParts <= 0 {
+		maxParts = s3manager.MaxUploadParts
+	}
+	partsPerTier := maxParts / 10
+	if partsPerTier == 0 {
+		partsPerTier = 1
+	}
+	partSize := int64(s3DefaultPartSize)
+	for tier := (partNumber - 1) / partsPerTier; tier > 0 && partSize < s3MaxPartSize; tier-- {
+		partSize *= 2
+	}
+	if partSize > s3MaxPartSize {
+		partSize = s3MaxPartSize
+	}
+	return partSize
+}
+
+// uploadToS3Multipart uploads a stream to S3 part by part, with several parts uploaded in parallel.
+// If partSize is 0, the part size grows as the upload progresses.
+// If a journal is provided, the upload is recorded in it under journalKey, and a recorded upload is continued from its last part
+func uploadToS3Multipart(s *session.Session, bucket, key, journalKey string, reader io.Reader, partSize int64, maxParts int, metadata map[string]*string, journal *Journal, verbose bool) error {
+	if maxParts <= 0 {
+		maxParts = s3manager.MaxUploadParts
+	}
+	svc := s3.New(s)
+
+	var parts []*s3.CompletedPart
+	var uploadID *string
+	if u, ok := journal.Upload(journalKey); ok {
+		uploaded, offset, err := listUploadedParts(svc, bucket, key, u.UploadID)
+		if err == nil {
 			if verbose {
-				log.Printf("Error: %v", err)
-				log.Printf("Attempt: %v", attempt)
+				log.Printf("Resuming upload to s3://%s/%s after %d parts (%d bytes)", bucket, key, len(uploaded), offset)
 			}
-			if attempt == attempts {
-				if verbose {
-					log.Printf("This was last attempt")
-				}
+			if _, err := io.CopyN(io.Discard, reader, offset); err != nil {
 				return err
 			}
-			utils.Sleep(attempt)
-			continue
+			uploadID = aws.String(u.UploadID)
+			partSize = u.PartSize
+			parts = uploaded
+		} else if verbose {
+			log.Printf("Can not resume upload to s3://%s/%s, starting over: %v", bucket, key, err)
 		}
-		return nil
+	}
+
+	partSizeOf := func(partNumber int) int64 {
+		if partSize != 0 {
+			return partSize
+		}
+		return adaptivePartSize(partNumber, maxParts)
+	}
+
+	var buf []byte
+	var err error
+	readAhead := false
+	if uploadID == nil {
+		// Small files fit in a single part and don't need a multipart upload
+		buf, err = readPart(reader, nil, partSizeOf(1))
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			_, err = svc.PutObject(&s3.PutObjectInput{
+				Bucket:   aws.String(bucket),
+				Key:      aws.String(key),
+				Body:     bytes.NewReader(buf),
+				Metadata: metadata,
+			})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		readAhead = true
+
+		mu, err := svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(key),
+			Metadata: metadata,
+		})
+		if err != nil {
+			return err
+		}
+		uploadID = mu.UploadId
+		if err := journal.StartUpload(journalKey, JournalUpload{UploadID: *uploadID, PartSize: partSize}); err != nil {
+			return err
+		}
+	}
+	abort := func(cause error) error {
+		// A journaled upload is kept so it can be resumed
+		if journal == nil {
+			svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(bucket),
+				Key:      aws.String(key),
+				UploadId: uploadID,
+			})
+		}
+		return cause
+	}
+
+	// Parts are uploaded in parallel, each from its own buffer. Buffers of uploaded parts are reused
+	var mu sync.Mutex
+	var uploadErr error
+	free := make(chan []byte, s3manager.DefaultUploadConcurrency)
+	bwg := utils.NewBoundedWaitGroup(s3manager.DefaultUploadConcurrency)
+	failed := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return uploadErr
+	}
+	for partNumber := len(parts) + 1; failed() == nil; partNumber++ {
+		if !readAhead {
+			select {
+			case buf = <-free:
+			default:
+				buf = nil
+			}
+			buf, err = readPart(reader, buf, partSizeOf(partNumber))
+			if err == io.EOF {
+				break
+			}
+			if err != nil && err != io.ErrUnexpectedEOF {
+				bwg.Wait()
+				return abort(err)
+			}
+		}
+		readAhead = false
+		if partNumber > maxParts {
+			bwg.Wait()
+			return abort(fmt.Errorf("upload exceeds the maximum of %d parts", maxParts))
+		}
+
+		bwg.Add(1)
+		go func(partNumber int, buf []byte) {
+			defer bwg.Done()
+			up, uErr := svc.UploadPart(&s3.UploadPartInput{
+				Bucket:     aws.String(bucket),
+				Key:        aws.String(key),
+				UploadId:   uploadID,
+				PartNumber: aws.Int64(int64(partNumber)),
+				Body:       bytes.NewReader(buf),
+			})
+			select {
+			case free <- buf:
+			default:
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if uErr != nil {
+				if uploadErr == nil {
+					uploadErr = uErr
+				}
+				return
+			}
+			parts = append(parts, &s3.CompletedPart{ETag: up.ETag, PartNumber: aws.Int64(int64(partNumber))})
+		}(partNumber, buf)
+
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+	bwg.Wait()
+	if uploadErr != nil {
+		return abort(uploadErr)
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return aws.Int64Value(parts[i].PartNumber) < aws.Int64Value(parts[j].PartNumber)
+	})
+
+	_, err = svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(key),
+		UploadId:        uploadID,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return abort(err)
 	}
 
 	return nil
 }
 
-// calculatePartSize calculates an appropriate part size for the multipart upload
-func calculatePartSize(fileSize int64) int64 {
-	const maxParts = 10000
-	partSize := fileSize / maxParts
-	if partSize < 5*1024*1024 {
-		partSize = 5 * 1024 * 1024 // Minimum part size of 5 MB
+// readPart reads a part of up to size bytes into buf, growing buf as the part is read,
+// so a small file (or the end of a file) doesn't take a whole part buffer.
+// It returns the part read, and io.EOF or io.ErrUnexpectedEOF as io.ReadFull does
+func readPart(reader io.Reader, buf []byte, size int64) ([]byte, error) {
+	buf = buf[:0]
+	for int64(len(buf)) < size {
+		if len(buf) == cap(buf) {
+			grown := 2 * int64(cap(buf))
+			if grown < s3MinPartSize {
+				grown = s3MinPartSize
+			}
+			if grown > size {
+				grown = size
+			}
+			buf = append(make([]byte, 0, grown), buf...)
+		}
+		end := int64(cap(buf))
+		if end > size {
+			end = size
+		}
+		n, err := io.ReadFull(reader, buf[len(buf):end])
+		buf = buf[:len(buf)+n]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if len(buf) == 0 {
+				return buf, io.EOF
+			}
+			return buf, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return buf, err
+		}
 	}
-	return partSize
+	return buf, nil
+}
+
+// listUploadedParts returns the consecutive parts already uploaded in a multipart upload and their total size
+func listUploadedParts(svc *s3.S3, bucket, key, uploadID string) ([]*s3.CompletedPart, int64, error) {
+	var parts []*s3.CompletedPart
+	var offset int64
+	consecutive := true
+	err := svc.ListPartsPages(&s3.ListPartsInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	}, func(p *s3.ListPartsOutput, last bool) bool {
+		for _, part := range p.Parts {
+			if aws.Int64Value(part.PartNumber) != int64(len(parts)+1) {
+				consecutive = false
+				return false
+			}
+			parts = append(parts, &s3.CompletedPart{ETag: part.ETag, PartNumber: part.PartNumber})
+			offset += aws.Int64Value(part.Size)
+		}
+		return consecutive
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return parts, offset, nil
 }
 
 func getNewSession() (*session.Session, error) {
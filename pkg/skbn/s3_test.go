@@ -0,0 +1,105 @@
+package skbn
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestCalculatePartSize(t *testing.T) {
+	const mb, gb = 1024 * 1024, 1024 * 1024 * 1024
+	tests := []struct {
+		name     string
+		fileSize int64
+		maxParts int
+		want     int64
+	}{
+		{"empty file", 0, 10000, s3DefaultPartSize},
+		{"small file", 1024, 10000, s3DefaultPartSize},
+		{"largest file of 128MB parts", 10000 * s3DefaultPartSize, 10000, s3DefaultPartSize},
+		{"one byte over 128MB parts", 10000*s3DefaultPartSize + 1, 10000, s3DefaultPartSize + 1},
+		{"default maximum of parts", 10000*s3DefaultPartSize + 1, 0, s3DefaultPartSize + 1},
+		{"few parts", 10 * gb, 10, gb},
+		{"rounded up", 10*gb + 1, 10, gb + 1},
+		{"largest object", 5 * 1024 * gb, 10000, 549755814},
+		{"capped at 5GB", 100 * gb, 10, s3MaxPartSize},
+		{"single part", 200 * mb, 1, 200 * mb},
+	}
+	for _, tt := range tests {
+		if got := calculatePartSize(tt.fileSize, tt.maxParts); got != tt.want {
+			t.Errorf("%s: calculatePartSize(%d, %d) = %d, want %d", tt.name, tt.fileSize, tt.maxParts, got, tt.want)
+		}
+	}
+}
+
+func TestAdaptivePartSize(t *testing.T) {
+	tests := []struct {
+		partNumber int
+		maxParts   int
+		want       int64
+	}{
+		{1, 10000, s3DefaultPartSize},
+		{1000, 10000, s3DefaultPartSize},
+		{1001, 10000, 2 * s3DefaultPartSize},
+		{2001, 10000, 4 * s3DefaultPartSize},
+		{5001, 10000, 32 * s3DefaultPartSize},
+		{6001, 10000, s3MaxPartSize},
+		{10000, 10000, s3MaxPartSize},
+		{1001, 0, 2 * s3DefaultPartSize},
+		{1, 5, s3DefaultPartSize},
+		{2, 5, 2 * s3DefaultPartSize},
+		{5, 5, 16 * s3DefaultPartSize},
+	}
+	for _, tt := range tests {
+		if got := adaptivePartSize(tt.partNumber, tt.maxParts); got != tt.want {
+			t.Errorf("adaptivePartSize(%d, %d) = %d, want %d", tt.partNumber, tt.maxParts, got, tt.want)
+		}
+	}
+
+	// 10000 parts hold the largest object of 5TB
+	var total int64
+	for i := 1; i <= 10000; i++ {
+		total += adaptivePartSize(i, 10000)
+	}
+	if total < 5*1024*1024*1024*1024 {
+		t.Errorf("10000 parts hold %d bytes, want at least 5TB", total)
+	}
+}
+
+func TestReadPart(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 2*s3MinPartSize/10)
+	tests := []struct {
+		name    string
+		size    int
+		partLen int64
+		want    int
+		wantErr error
+		maxCap  int
+	}{
+		{"empty", 0, s3DefaultPartSize, 0, io.EOF, s3MinPartSize},
+		{"small", 1024, s3DefaultPartSize, 1024, io.ErrUnexpectedEOF, s3MinPartSize},
+		{"grown", s3MinPartSize + 1, s3DefaultPartSize, s3MinPartSize + 1, io.ErrUnexpectedEOF, 2 * s3MinPartSize},
+		{"exact part", s3MinPartSize, s3MinPartSize, s3MinPartSize, nil, s3MinPartSize},
+		{"full part", 2 * s3MinPartSize, s3MinPartSize + 10, s3MinPartSize + 10, nil, s3MinPartSize + 10},
+	}
+	for _, tt := range tests {
+		reader := iotest.HalfReader(bytes.NewReader(data[:tt.size]))
+		buf, err := readPart(reader, nil, tt.partLen)
+		if err != tt.wantErr {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if !bytes.Equal(buf, data[:tt.want]) {
+			t.Errorf("%s: got %d bytes, want the first %d bytes", tt.name, len(buf), tt.want)
+		}
+		if cap(buf) > tt.maxCap {
+			t.Errorf("%s: got a buffer of %d bytes, want at most %d", tt.name, cap(buf), tt.maxCap)
+		}
+	}
+
+	// A reused buffer is read into from its start
+	buf, err := readPart(bytes.NewReader(data[:10]), make([]byte, 3, s3MinPartSize), s3DefaultPartSize)
+	if err != io.ErrUnexpectedEOF || !bytes.Equal(buf, data[:10]) {
+		t.Errorf("got %q and %v, want %q and %v", buf, err, data[:10], io.ErrUnexpectedEOF)
+	}
+}
@@ -0,0 +1,406 @@
+package skbn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nuvo/skbn/pkg/utils"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	s3CopyPartSize      = 512 * 1024 * 1024 // 512 MB, the default part size of a multipart copy
+	s3CopyConcurrency   = 8                 // number of parts copied in parallel
+	absCopyBlockSize    = 100 * 1024 * 1024 // 100 MB, the size of a block staged from a URL
+	absCopyConcurrency  = 8                 // number of blocks staged in parallel
+	absCopyFromURLMax   = 256 * 1024 * 1024 // 256 MB, larger blobs are copied block by block
+	absCopyPollInterval = time.Second
+	absCopySASExpiry    = 24 * time.Hour
+)
+
+// errNoServerCopy means a file can not be copied on the server, and has to be streamed through skbn
+var errNoServerCopy = errors.New("server-side copy is not possible")
+
+// serverCopy copies a single file without streaming it through skbn, when the source and the destination are
+// in the same provider. It returns false if the file has to be streamed instead,
+// e.g. when the source and the destination are in different accounts or regions
+func serverCopy(srcClient, dstClient interface{}, srcPrefix, fromPath, dstPrefix, toPath string, size int64, opts CopyOptions) (bool, error) {
+	if opts.NoServerCopy || srcPrefix != dstPrefix {
+		return false, nil
+	}
+
+	var err error
+	switch srcPrefix {
+	case "s3":
+		err = copyS3ToS3(dstClient, fromPath, toPath, size, opts)
+	case "abs":
+		err = copyAbsToAbs(srcClient, dstClient, fromPath, toPath, size, opts.Retry, opts.Verbose)
+	default:
+		return false, nil
+	}
+	if errors.Is(err, errNoServerCopy) {
+		if opts.Verbose {
+			log.Printf("Streaming %s://%s -> %s://%s: %v", srcPrefix, fromPath, dstPrefix, toPath, err)
+		}
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// noServerCopy wraps err with errNoServerCopy
+func noServerCopy(err error) error {
+	return fmt.Errorf("%w: %v", errNoServerCopy, err)
+}
+
+// copyS3ToS3 copies an object with CopyObject, or part by part with UploadPartCopy if it is larger than a single copy allows.
+// The metadata of the object is copied with it
+func copyS3ToS3(iClient interface{}, fromPath, toPath string, size int64, opts CopyOptions) error {
+	svc := s3.New(iClient.(*session.Session))
+	srcSplit := strings.Split(fromPath, "/")
+	if err := validateS3Path(srcSplit); err != nil {
+		return err
+	}
+	dstSplit := strings.Split(toPath, "/")
+	if err := validateS3Path(dstSplit); err != nil {
+		return err
+	}
+	if len(dstSplit) == 1 {
+		_, fileName := filepath.Split(fromPath)
+		dstSplit = append(dstSplit, fileName)
+	}
+	srcBucket, srcKey := initS3Variables(srcSplit)
+	dstBucket, dstKey := initS3Variables(dstSplit)
+	source := s3CopySource(srcBucket, srcKey)
+
+	var head *s3.HeadObjectOutput
+	if size < 0 || size > s3MaxPartSize {
+		err := opts.Retry.Do(func(attempt int) error {
+			var err error
+			head, err = svc.HeadObject(&s3.HeadObjectInput{
+				Bucket: aws.String(srcBucket),
+				Key:    aws.String(srcKey),
+			})
+			return s3Retryable(err)
+		})
+		if err != nil {
+			return s3CopyError(err)
+		}
+		size = aws.Int64Value(head.ContentLength)
+	}
+	if size > s3MaxPartSize {
+		return copyS3Multipart(svc, source, head, dstBucket, dstKey, opts)
+	}
+
+	if opts.Verbose {
+		log.Printf("Copying s3://%s/%s to s3://%s/%s on the server", srcBucket, srcKey, dstBucket, dstKey)
+	}
+	err := opts.Retry.Do(func(attempt int) error {
+		_, err := svc.CopyObject(&s3.CopyObjectInput{
+			Bucket:            aws.String(dstBucket),
+			Key:               aws.String(dstKey),
+			CopySource:        aws.String(source),
+			MetadataDirective: aws.String(s3.MetadataDirectiveCopy),
+		})
+		return s3Retryable(err)
+	})
+	return s3CopyError(err)
+}
+
+// s3CopySource returns the URL encoded source of a copy
+func s3CopySource(bucket, key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		// S3 decodes + as a space
+		segments[i] = strings.ReplaceAll(url.PathEscape(segment), "+", "%2B")
+	}
+	return bucket + "/" + strings.Join(segments, "/")
+}
+
+// copyS3Multipart copies an object described by head part by part, with the parts copied in parallel
+func copyS3Multipart(svc *s3.S3, source string, head *s3.HeadObjectOutput, dstBucket, dstKey string, opts CopyOptions) error {
+	size := aws.Int64Value(head.ContentLength)
+	partSize := calculatePartSize(size, opts.S3MaxUploadParts)
+	minPartSize := int64(s3CopyPartSize)
+	if opts.S3PartSize != 0 {
+		minPartSize = opts.S3PartSize
+	}
+	if partSize < minPartSize {
+		partSize = minPartSize
+	}
+	partCount := int((size + partSize - 1) / partSize)
+	if opts.Verbose {
+		log.Printf("Copying %s to s3://%s/%s on the server in %d parts", source, dstBucket, dstKey, partCount)
+	}
+
+	var mu *s3.CreateMultipartUploadOutput
+	err := opts.Retry.Do(func(attempt int) error {
+		var err error
+		mu, err = svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+			Bucket:          aws.String(dstBucket),
+			Key:             aws.String(dstKey),
+			Metadata:        head.Metadata,
+			ContentType:     head.ContentType,
+			ContentEncoding: head.ContentEncoding,
+		})
+		return s3Retryable(err)
+	})
+	if err != nil {
+		return s3CopyError(err)
+	}
+
+	parts := make([]*s3.CompletedPart, partCount)
+	bwg := utils.NewBoundedWaitGroup(s3CopyConcurrency)
+	errc := make(chan error, 1)
+	for i := 0; i < partCount; i++ {
+		if len(errc) != 0 {
+			break
+		}
+		bwg.Add(1)
+		go func(i int) {
+			defer bwg.Done()
+			first := int64(i) * partSize
+			last := first + partSize - 1
+			if last >= size {
+				last = size - 1
+			}
+			err := opts.Retry.Do(func(attempt int) error {
+				out, err := svc.UploadPartCopy(&s3.UploadPartCopyInput{
+					Bucket:            aws.String(dstBucket),
+					Key:               aws.String(dstKey),
+					UploadId:          mu.UploadId,
+					PartNumber:        aws.Int64(int64(i + 1)),
+					CopySource:        aws.String(source),
+					CopySourceRange:   aws.String(fmt.Sprintf("bytes=%d-%d", first, last)),
+					CopySourceIfMatch: head.ETag,
+				})
+				if err != nil {
+					return s3Retryable(err)
+				}
+				parts[i] = &s3.CompletedPart{ETag: out.CopyPartResult.ETag, PartNumber: aws.Int64(int64(i + 1))}
+				return nil
+			})
+			if err != nil {
+				select {
+				case errc <- err:
+				default:
+				}
+			}
+		}(i)
+	}
+	bwg.Wait()
+
+	if len(errc) == 0 {
+		err = opts.Retry.Do(func(attempt int) error {
+			_, err := svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+				Bucket:          aws.String(dstBucket),
+				Key:             aws.String(dstKey),
+				UploadId:        mu.UploadId,
+				MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+			})
+			return s3Retryable(err)
+		})
+	} else {
+		err = <-errc
+	}
+	if err != nil {
+		svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(dstBucket),
+			Key:      aws.String(dstKey),
+			UploadId: mu.UploadId,
+		})
+		return s3CopyError(err)
+	}
+
+	return nil
+}
+
+// s3CopyError marks the errors of a copy between regions or accounts, which a streamed copy may not have
+func s3CopyError(err error) error {
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		switch reqErr.StatusCode() {
+		case http.StatusMovedPermanently, http.StatusBadRequest, http.StatusForbidden:
+			return noServerCopy(err)
+		}
+	}
+	return err
+}
+
+// copyAbsToAbs copies a blob within a storage account, with StartCopyFromURL, or block by block with PutBlockFromURL
+// if it is large. The source is read through a SAS, signed with the shared key of the account.
+// The metadata of the blob is copied with it
+func copyAbsToAbs(srcClient, dstClient interface{}, fromPath, toPath string, size int64, retry utils.RetryPolicy, verbose bool) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srcSplit := strings.Split(fromPath, "/")
+	if err := validateAbsPath(srcSplit); err != nil {
+		return err
+	}
+	dstSplit := strings.Split(toPath, "/")
+	if err := validateAbsPath(dstSplit); err != nil {
+		return err
+	}
+	if len(dstSplit) == 1 {
+		_, fn := filepath.Split(fromPath)
+		dstSplit = append(dstSplit, fn)
+	}
+	sa, sc, sp := initAbsVariables(srcSplit)
+	da, dc, dp := initAbsVariables(dstSplit)
+	if sa != da {
+		return noServerCopy(fmt.Errorf("%s and %s are different storage accounts", sa, da))
+	}
+
+	scu, err := getContainerURL(srcClient.(pipeline.Pipeline), sa, sc)
+	if err != nil {
+		return err
+	}
+	dcu, err := getContainerURL(dstClient.(pipeline.Pipeline), da, dc)
+	if err != nil {
+		return err
+	}
+	sbu, dbu := getBlobURL(scu, sp), getBlobURL(dcu, dp)
+	source, err := absSourceURL(sbu, sc, sp)
+	if err != nil {
+		return err
+	}
+
+	if size >= 0 && size <= absCopyFromURLMax {
+		err = copyAbsFromURL(ctx, dbu, source, verbose)
+	} else {
+		err = copyAbsBlocks(ctx, sbu, dbu, source, retry, verbose)
+	}
+	var stErr azblob.StorageError
+	if errors.As(err, &stErr) && (stErr.ServiceCode() == azblob.ServiceCodeCannotVerifyCopySource || stErr.Response().StatusCode == http.StatusForbidden) {
+		return noServerCopy(err)
+	}
+	return err
+}
+
+// absSourceURL returns the URL of a blob with a read only SAS
+func absSourceURL(bu azblob.BlockBlobURL, container, blob string) (url.URL, error) {
+	credential, err := getAbsCredential()
+	if err != nil {
+		return url.URL{}, err
+	}
+	sas, err := azblob.BlobSASSignatureValues{
+		Protocol:      azblob.SASProtocolHTTPS,
+		ExpiryTime:    time.Now().UTC().Add(absCopySASExpiry),
+		Permissions:   azblob.BlobSASPermissions{Read: true}.String(),
+		ContainerName: container,
+		BlobName:      blob,
+	}.NewSASQueryParameters(credential)
+	if err != nil {
+		return url.URL{}, err
+	}
+
+	parts := azblob.NewBlobURLParts(bu.URL())
+	parts.SAS = sas
+	return parts.URL(), nil
+}
+
+// copyAbsFromURL starts an asynchronous copy of a blob, and polls the destination until the copy completes
+func copyAbsFromURL(ctx context.Context, bu azblob.BlockBlobURL, source url.URL, verbose bool) error {
+	if verbose {
+		log.Printf("Copying to %s on the server", bu.String())
+	}
+	resp, err := bu.StartCopyFromURL(ctx, source, nil, azblob.ModifiedAccessConditions{}, azblob.BlobAccessConditions{}, azblob.DefaultAccessTier, nil)
+	if err != nil {
+		return err
+	}
+
+	status, description := resp.CopyStatus(), ""
+	for status == azblob.CopyStatusPending {
+		time.Sleep(absCopyPollInterval)
+		props, err := bu.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+		if err != nil {
+			return err
+		}
+		if props.CopyID() != resp.CopyID() {
+			return fmt.Errorf("copy to %s was replaced by another copy", bu.String())
+		}
+		status, description = props.CopyStatus(), props.CopyStatusDescription()
+		if verbose {
+			log.Printf("Copying to %s: %s bytes", bu.String(), props.CopyProgress())
+		}
+	}
+	if status != azblob.CopyStatusSuccess {
+		return fmt.Errorf("copy to %s %s: %s", bu.String(), status, description)
+	}
+
+	return nil
+}
+
+// copyAbsBlocks copies a blob by staging its blocks from the source URL in parallel,
+// allowing each attempt to stage a block as long as uploading it would take.
+// The source is required to be unchanged until all the blocks are staged
+func copyAbsBlocks(ctx context.Context, sbu, dbu azblob.BlockBlobURL, source url.URL, retry utils.RetryPolicy, verbose bool) error {
+	props, err := sbu.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return err
+	}
+	size := props.ContentLength()
+
+	blockSize := int64(absCopyBlockSize)
+	if size > blockSize*absMaxBlocks {
+		blockSize = (size + absMaxBlocks - 1) / absMaxBlocks
+	}
+	blockCount := int((size + blockSize - 1) / blockSize)
+	if verbose {
+		log.Printf("Copying to %s on the server in %d blocks", dbu.String(), blockCount)
+	}
+	p, err := newAbsPipeline(retry, absTryTimeout(blockSize))
+	if err != nil {
+		return err
+	}
+	dbu = dbu.WithPipeline(p)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ids := make([]string, blockCount)
+	bwg := utils.NewBoundedWaitGroup(absCopyConcurrency)
+	errc := make(chan error, 1)
+	for i := 0; i < blockCount; i++ {
+		if len(errc) != 0 {
+			break
+		}
+		ids[i] = absBlockID(i)
+		bwg.Add(1)
+		go func(i int) {
+			defer bwg.Done()
+			offset := int64(i) * blockSize
+			count := blockSize
+			if offset+count > size {
+				count = size - offset
+			}
+			_, err := dbu.StageBlockFromURL(ctx, ids[i], source, offset, count, azblob.LeaseAccessConditions{}, azblob.ModifiedAccessConditions{IfMatch: props.ETag()}, azblob.ClientProvidedKeyOptions{}, nil)
+			if err != nil {
+				select {
+				case errc <- err:
+					cancel()
+				default:
+				}
+			}
+		}(i)
+	}
+	bwg.Wait()
+	if len(errc) != 0 {
+		return <-errc
+	}
+
+	_, err = dbu.CommitBlockList(ctx, ids, props.NewHTTPHeaders(), props.NewMetadata(), azblob.BlobAccessConditions{}, azblob.DefaultAccessTier, nil, azblob.ClientProvidedKeyOptions{}, azblob.ImmutabilityPolicyOptions{})
+	return err
+}
@@ -3,10 +3,14 @@ package skbn
 import (
 	"context"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"math"
 	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
 
 	"github.com/nuvo/skbn/pkg/utils"
 
@@ -16,28 +20,156 @@ import (
 
 // FromToPair is a pair of FromPath and ToPath
 type FromToPair struct {
-	FromPath string
-	ToPath   string
+	FromPath   string
+	ToPath     string
+	Size       int64      // -1 if unknown
+	Attrs      *FileAttrs // nil if unknown
+	IsDir      bool       // an empty directory
+	LinkTarget string     // the target of a symbolic link, empty for other files
+	ModTime    time.Time  // zero if unknown
+}
+
+// FileInfo holds a path relative to the listed path, the size of the file and its attributes
+type FileInfo struct {
+	RelativePath string
+	Size         int64      // -1 if unknown
+	Attrs        *FileAttrs // nil if unknown
+	IsDir        bool       // an empty directory, or a subdirectory in a listing that is not recursive
+	LinkTarget   string     // the target of a symbolic link, empty for other files
+	ModTime      time.Time  // zero if unknown
+}
+
+// CopyOptions holds the settings of a copy
+type CopyOptions struct {
+	Parallel         int     // number of files to copy in parallel, 0 for full parallelism
+	BufferSize       float64 // in memory buffer size (MB) per file
+	S3PartSize       int64   // 0 to calculate the part size from the file size
+	S3MaxUploadParts int
+	Verbose          bool
+	JournalPath      string            // local file, or object in S3 or Azure Blob Storage, to record the progress in. Empty to disable
+	Resume           bool              // skip the files recorded as done in the journal and continue partial uploads
+	Retry            utils.RetryPolicy // zero values are taken from utils.DefaultRetryPolicy
+	FanOut           bool              // copy from (or to) every pod selected by a Kubernetes path
+	SrcK8s           K8sClientOptions  // kubeconfig, context and identity for a Kubernetes source
+	DstK8s           K8sClientOptions  // kubeconfig, context and identity for a Kubernetes destination
+	PreHook          string            // shell command to run in the Kubernetes containers before the copy starts
+	PostHook         string            // shell command to run in the Kubernetes containers after the copy ends, even if it failed
+	HookTarget       string            // HookTargetSrc (default) or HookTargetDst
+	Preserve         bool              // preserve the permissions, ownership and modification time of files
+	Symlinks         string            // SymlinksSkip (default), SymlinksFollow or SymlinksCopy
+	EmptyDirs        bool              // copy empty directories
+	NoMultiplex      bool              // don't transfer small files from (or to) Kubernetes over a single exec stream per container
+	Move             bool              // remove each source file once its copy is verified
+	Verify           string            // VerifySize (default) or VerifyChecksum, how a moved file is verified
+	NoServerCopy     bool              // stream S3 to S3 and Azure to Azure copies through skbn, instead of copying them on the server
+
+	budget *utils.BoundedWaitGroup // limits the files copied in parallel across the copies of a batch
+	stats  *copyStats              // counts the copied files
 }
 
 // Copy copies files from src to dst
 func Copy(src, dst string, parallel int, bufferSize float64, s3partSize int64, s3maxUploadParts int, verbose bool) error {
+	return CopyWithOptions(src, dst, CopyOptions{
+		Parallel:         parallel,
+		BufferSize:       bufferSize,
+		S3PartSize:       s3partSize,
+		S3MaxUploadParts: s3maxUploadParts,
+		Verbose:          verbose,
+	})
+}
+
+// CopyWithOptions copies files from src to dst
+func CopyWithOptions(src, dst string, opts CopyOptions) (err error) {
+	if opts.Resume && opts.JournalPath == "" {
+		return fmt.Errorf("resume requires a journal")
+	}
+	if err := ValidateSymlinks(opts.Symlinks); err != nil {
+		return err
+	}
+	if err := ValidateVerify(opts.Verify); err != nil {
+		return err
+	}
+	for _, k8s := range []K8sClientOptions{opts.SrcK8s, opts.DstK8s} {
+		if err := ValidateExecTransport(k8s.ExecTransport); err != nil {
+			return err
+		}
+	}
+	if src == StdioPath || dst == StdioPath {
+		return copyStdio(src, dst, opts)
+	}
+
 	srcPrefix, srcPath := utils.SplitInTwo(src, "://")
 	dstPrefix, dstPath := utils.SplitInTwo(dst, "://")
 
-	err := TestImplementationsExist(srcPrefix, dstPrefix)
+	err = TestImplementationsExist(srcPrefix, dstPrefix)
 	if err != nil {
 		return err
 	}
-	srcClient, dstClient, err := GetClients(srcPrefix, dstPrefix, srcPath, dstPath)
-	if err != nil {
+	if srcPath, err = unescapePath(srcPrefix, srcPath); err != nil {
 		return err
 	}
-	fromToPaths, err := GetFromToPaths(srcClient, srcPrefix, srcPath, dstPath)
+	if dstPath, err = unescapePath(dstPrefix, dstPath); err != nil {
+		return err
+	}
+	if srcPrefix == "k8s" || srcPrefix == "pvc" {
+		srcPath, opts.SrcK8s = SplitK8sContext(srcPath, opts.SrcK8s)
+	}
+	if dstPrefix == "k8s" || dstPrefix == "pvc" {
+		dstPath, opts.DstK8s = SplitK8sContext(dstPath, opts.DstK8s)
+	}
+	srcClient, dstClient, err := getClients(srcPrefix, dstPrefix, srcPath, dstPath, opts.SrcK8s, opts.DstK8s, opts.Retry)
 	if err != nil {
 		return err
 	}
-	err = PerformCopy(srcClient, dstClient, srcPrefix, dstPrefix, fromToPaths, parallel, bufferSize, s3partSize, s3maxUploadParts, verbose)
+	defer closeClients(srcClient, dstClient)
+
+	if opts.PreHook != "" || opts.PostHook != "" {
+		hookClient, hookPaths, err := getHookPaths(srcClient, dstClient, srcPrefix, dstPrefix, srcPath, dstPath, opts)
+		if err != nil {
+			return err
+		}
+		if opts.PostHook != "" {
+			// Registered before the pre-hook runs, to undo a pre-hook that failed halfway
+			defer func() {
+				if hookErr := runHook(hookClient, hookPaths, "post-hook", opts.PostHook, true, opts.Verbose); hookErr != nil {
+					if err != nil {
+						err = fmt.Errorf("%v, and %v", err, hookErr)
+					} else {
+						err = hookErr
+					}
+				}
+			}()
+		}
+		if opts.PreHook != "" {
+			if err := runHook(hookClient, hookPaths, "pre-hook", opts.PreHook, false, opts.Verbose); err != nil {
+				return err
+			}
+		}
+	}
+
+	var fromToPaths []FromToPair
+	if opts.FanOut && (srcPrefix == "k8s" || dstPrefix == "k8s") {
+		fromToPaths, err = getFanOutFromToPaths(srcClient, dstClient, srcPrefix, dstPrefix, srcPath, dstPath, opts.listOptions(), opts.Retry)
+		if err != nil {
+			return err
+		}
+	} else {
+		if srcPrefix == "k8s" {
+			if srcPath, err = ResolveK8sPath(srcClient, srcPath); err != nil {
+				return err
+			}
+		}
+		if dstPrefix == "k8s" {
+			if dstPath, err = ResolveK8sPath(dstClient, dstPath); err != nil {
+				return err
+			}
+		}
+		fromToPaths, err = getFromToPaths(srcClient, srcPrefix, srcPath, dstPath, opts.listOptions(), opts.Retry)
+		if err != nil {
+			return err
+		}
+	}
+	err = PerformCopyWithOptions(srcClient, dstClient, srcPrefix, dstPrefix, fromToPaths, opts)
 	if err != nil {
 		return err
 	}
@@ -49,18 +181,20 @@ func Copy(src, dst string, parallel int, bufferSize float64, s3partSize int64, s
 func TestImplementationsExist(srcPrefix, dstPrefix string) error {
 	switch srcPrefix {
 	case "k8s":
+	case "pvc":
 	case "s3":
 	case "abs":
 	default:
-		return fmt.Errorf(srcPrefix + " not implemented")
+		return fmt.Errorf("%s not implemented", srcPrefix)
 	}
 
 	switch dstPrefix {
 	case "k8s":
+	case "pvc":
 	case "s3":
 	case "abs":
 	default:
-		return fmt.Errorf(dstPrefix + " not implemented")
+		return fmt.Errorf("%s not implemented", dstPrefix)
 	}
 
 	return nil
@@ -68,14 +202,30 @@ func TestImplementationsExist(srcPrefix, dstPrefix string) error {
 
 // GetClients gets the clients for the source and destination
 func GetClients(srcPrefix, dstPrefix, srcPath, dstPath string) (interface{}, interface{}, error) {
+	return getClients(srcPrefix, dstPrefix, srcPath, dstPath, K8sClientOptions{}, K8sClientOptions{}, utils.DefaultRetryPolicy())
+}
+
+// unescapePath decodes the URL escaped components of a path after the prefix
+func unescapePath(prefix, path string) (string, error) {
+	if prefix == "k8s" {
+		return unescapeK8sPath(path)
+	}
+	return utils.UnescapePath(path)
+}
+
+func getClients(srcPrefix, dstPrefix, srcPath, dstPath string, srcK8s, dstK8s K8sClientOptions, retry utils.RetryPolicy) (interface{}, interface{}, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	srcClient, tested, err := initClient(ctx, nil, srcPrefix, srcPath, "")
+	srcClient, tested, err := initClient(ctx, nil, srcPrefix, srcPath, "", srcK8s, retry)
 	if err != nil {
 		return nil, nil, err
 	}
-	dstClient, _, err := initClient(ctx, srcClient, dstPrefix, dstPath, tested)
+	// Kubernetes clients for different clusters or identities can not be shared
+	if (tested == "k8s" || tested == "pvc") && !reflect.DeepEqual(srcK8s, dstK8s) {
+		tested = ""
+	}
+	dstClient, _, err := initClient(ctx, srcClient, dstPrefix, dstPath, tested, dstK8s, retry)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -83,18 +233,87 @@ func GetClients(srcPrefix, dstPrefix, srcPath, dstPath string) (interface{}, int
 	return srcClient, dstClient, nil
 }
 
+// closeClients releases resources held by clients, such as debug containers
+func closeClients(clients ...interface{}) {
+	for _, c := range clients {
+		if k8sClient, ok := c.(*K8sClient); ok {
+			if err := k8sClient.Close(); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
 // GetFromToPaths gets from and to paths to perform the copy on
 func GetFromToPaths(srcClient interface{}, srcPrefix, srcPath, dstPath string) ([]FromToPair, error) {
-	relativePaths, err := GetListOfFiles(srcClient, srcPrefix, srcPath)
+	return getFromToPaths(srcClient, srcPrefix, srcPath, dstPath, listOptions{}, utils.DefaultRetryPolicy())
+}
+
+func getFromToPaths(srcClient interface{}, srcPrefix, srcPath, dstPath string, lo listOptions, retry utils.RetryPolicy) ([]FromToPair, error) {
+	files, err := getListOfFiles(srcClient, srcPrefix, srcPath, lo, retry)
+	if err != nil {
+		return nil, err
+	}
+
+	var fromToPaths []FromToPair
+	for _, file := range files {
+		if file.IsDir && !lo.emptyDirs {
+			continue
+		}
+		fromPath := filepath.Join(srcPath, file.RelativePath)
+		toPath := filepath.Join(dstPath, file.RelativePath)
+		fromToPaths = append(fromToPaths, FromToPair{
+			FromPath:   fromPath,
+			ToPath:     toPath,
+			Size:       file.Size,
+			Attrs:      file.Attrs,
+			IsDir:      file.IsDir,
+			LinkTarget: file.LinkTarget,
+			ModTime:    file.ModTime,
+		})
+	}
+
+	return fromToPaths, nil
+}
+
+// getFanOutFromToPaths gets from and to paths for each pod selected by the Kubernetes source,
+// or by the Kubernetes destination if the source is not in Kubernetes.
+// {pod}, {node} and {namespace} in the paths are replaced with the values of each pod
+func getFanOutFromToPaths(srcClient, dstClient interface{}, srcPrefix, dstPrefix, srcPath, dstPath string, lo listOptions, retry utils.RetryPolicy) ([]FromToPair, error) {
+	fanOutSrc := srcPrefix == "k8s"
+	k8sClient, k8sPath := dstClient, dstPath
+	if fanOutSrc {
+		k8sClient, k8sPath = srcClient, srcPath
+	}
+
+	paths, pods, err := ExpandK8sPath(k8sClient, k8sPath)
 	if err != nil {
 		return nil, err
 	}
+	if fanOutSrc && len(pods) > 1 && !strings.Contains(dstPath, "{pod}") {
+		return nil, fmt.Errorf("destination path must contain {pod} when copying from %d pods", len(pods))
+	}
 
 	var fromToPaths []FromToPair
-	for _, relativePath := range relativePaths {
-		fromPath := filepath.Join(srcPath, relativePath)
-		toPath := filepath.Join(dstPath, relativePath)
-		fromToPaths = append(fromToPaths, FromToPair{FromPath: fromPath, ToPath: toPath})
+	for i, pod := range pods {
+		podSrcPath := ExpandPodPlaceholders(srcPath, pod)
+		podDstPath := ExpandPodPlaceholders(dstPath, pod)
+		if fanOutSrc {
+			podSrcPath = paths[i]
+			if dstPrefix == "k8s" {
+				if podDstPath, err = ResolveK8sPath(dstClient, podDstPath); err != nil {
+					return nil, err
+				}
+			}
+		} else {
+			podDstPath = paths[i]
+		}
+
+		podFromToPaths, err := getFromToPaths(srcClient, srcPrefix, podSrcPath, podDstPath, lo, retry)
+		if err != nil {
+			return nil, err
+		}
+		fromToPaths = append(fromToPaths, podFromToPaths...)
 	}
 
 	return fromToPaths, nil
@@ -102,15 +321,42 @@ func GetFromToPaths(srcClient interface{}, srcPrefix, srcPath, dstPath string) (
 
 // PerformCopy performs the actual copy action
 func PerformCopy(srcClient, dstClient interface{}, srcPrefix, dstPrefix string, fromToPaths []FromToPair, parallel int, bufferSize float64, s3partSize int64, s3maxUploadParts int, verbose bool) error {
+	return PerformCopyWithOptions(srcClient, dstClient, srcPrefix, dstPrefix, fromToPaths, CopyOptions{
+		Parallel:         parallel,
+		BufferSize:       bufferSize,
+		S3PartSize:       s3partSize,
+		S3MaxUploadParts: s3maxUploadParts,
+		Verbose:          verbose,
+	})
+}
+
+// PerformCopyWithOptions performs the actual copy action
+func PerformCopyWithOptions(srcClient, dstClient interface{}, srcPrefix, dstPrefix string, fromToPaths []FromToPair, opts CopyOptions) (err error) {
+	var journal *Journal
+	if opts.JournalPath != "" {
+		j, err := openJournal(opts.JournalPath, opts.Resume, opts.Retry)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			// The last progress of a journal in S3 or Azure Blob Storage is stored when it is closed
+			if closeErr := j.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+		journal = j
+	}
 
 	// Execute in parallel
 	totalFiles := len(fromToPaths)
+	parallel := opts.Parallel
 	if parallel == 0 {
 		parallel = totalFiles
 	}
 	bwgSize := int(math.Min(float64(parallel), float64(totalFiles))) // Very stingy :)
 	bwg := utils.NewBoundedWaitGroup(bwgSize)
 	errc := make(chan error, 1)
+	multiplex := !opts.NoMultiplex && totalFiles >= multiplexMinFiles
 	currentLine := 0
 	for _, ftp := range fromToPaths {
 
@@ -118,50 +364,83 @@ func PerformCopy(srcClient, dstClient interface{}, srcPrefix, dstPrefix string,
 			break
 		}
 
-		bwg.Add(1)
 		currentLine++
 
 		totalDigits := utils.CountDigits(totalFiles)
 		currentLinePadded := utils.LeftPad2Len(currentLine, 0, totalDigits)
 
-		go func(srcClient, dstClient interface{}, srcPrefix, fromPath, dstPrefix, toPath, currentLinePadded string, totalFiles int) {
+		if journal.IsDone(ftp.FromPath, ftp.ToPath) {
+			log.Printf("[%s/%d] skip: %s://%s -> %s://%s", currentLinePadded, totalFiles, srcPrefix, ftp.FromPath, dstPrefix, ftp.ToPath)
+			continue
+		}
+
+		bwg.Add(1)
 
+		go func(srcClient, dstClient interface{}, srcPrefix, dstPrefix, currentLinePadded string, totalFiles int, ftp FromToPair) {
+			defer bwg.Done()
+			if opts.budget != nil {
+				opts.budget.Add(1)
+				defer opts.budget.Done()
+			}
 			if len(errc) != 0 {
 				return
 			}
+			fromPath, toPath := ftp.FromPath, ftp.ToPath
 
-			newBufferSize := (int64)(bufferSize * 1024 * 1024) // may not be super accurate
-			buf := buffer.New(newBufferSize)
-			pr, pw := nio.Pipe(buf)
-
-			log.Printf("[%s/%d] copy: %s://%s -> %s://%s", currentLinePadded, totalFiles, srcPrefix, fromPath, dstPrefix, toPath)
+			ftp, err := completeFromToPair(srcClient, srcPrefix, ftp, opts.Preserve)
+			if err == nil && ftp.LinkTarget != "" && opts.Symlinks != SymlinksCopy {
+				log.Printf("[%s/%d] skip symbolic link: %s://%s", currentLinePadded, totalFiles, srcPrefix, fromPath)
+				return
+			}
+			attrs := ftp.Attrs
+			if !opts.Preserve {
+				attrs = nil
+			}
 
-			go func() {
-				defer pw.Close()
-				if len(errc) != 0 {
-					return
+			if err == nil {
+				log.Printf("[%s/%d] copy: %s://%s -> %s://%s", currentLinePadded, totalFiles, srcPrefix, fromPath, dstPrefix, toPath)
+				if ftp.IsDir || ftp.LinkTarget != "" {
+					err = createSpecial(dstClient, dstPrefix, toPath, ftp, attrs, opts.Retry)
+					if err == nil && opts.Move {
+						err = verifySpecial(dstClient, dstPrefix, toPath, ftp, opts.Retry)
+					}
+				} else {
+					if multiplex && 0 <= ftp.Size && ftp.Size <= multiplexMaxSize {
+						srcClient, dstClient = multiplexed(srcClient, srcPrefix), multiplexed(dstClient, dstPrefix)
+					}
+					sum := newVerifyHash(opts)
+					var copied bool
+					copied, err = serverCopy(srcClient, dstClient, srcPrefix, fromPath, dstPrefix, toPath, ftp.Size, opts)
+					if err == nil && !copied {
+						journal.SetSource(toPath, ftp.Size, ftp.ModTime)
+						err = transfer(srcClient, dstClient, srcPrefix, fromPath, dstPrefix, toPath, ftp.Size, attrs, journal, sum, opts)
+					} else if err == nil && sum != nil {
+						// The data was not streamed through skbn, so the source is read to verify the copy
+						err = download(srcClient, srcPrefix, fromPath, sum, opts.Retry, opts.Verbose)
+					}
+					if err == nil && opts.Move {
+						err = verifyCopy(srcClient, dstClient, srcPrefix, fromPath, dstPrefix, toPath, ftp.Size, sum, opts.Retry, opts.Verbose)
+					}
 				}
-				err := Download(srcClient, srcPrefix, fromPath, pw, verbose)
-				if err != nil {
-					log.Println(err, fmt.Sprintf(" src: file: %s", fromPath))
-					errc <- err
+			}
+			// The source is removed before the file is marked as done, so a resumed move does not leave it behind
+			if err == nil && opts.Move && !ftp.IsDir {
+				err = removeSource(srcClient, srcPrefix, fromPath, opts.Retry)
+			}
+			if err == nil {
+				err = journal.MarkDone(fromPath, toPath)
+			}
+			if err != nil {
+				select {
+				case errc <- err:
+				default:
 				}
-			}()
+				return
+			}
 
-			go func() {
-				defer bwg.Done()
-				defer pr.Close()
-				if len(errc) != 0 {
-					return
-				}
-				defer log.Printf("[%s/%d] done: %s://%s -> %s://%s", currentLinePadded, totalFiles, srcPrefix, fromPath, dstPrefix, toPath)
-				err := Upload(dstClient, dstPrefix, toPath, fromPath, pr, s3partSize, s3maxUploadParts, verbose)
-				if err != nil {
-					log.Println(err, fmt.Sprintf(" dst: file: %s", toPath))
-					errc <- err
-				}
-			}()
-		}(srcClient, dstClient, srcPrefix, ftp.FromPath, dstPrefix, ftp.ToPath, currentLinePadded, totalFiles)
+			opts.stats.add(ftp.Size)
+			log.Printf("[%s/%d] done: %s://%s -> %s://%s", currentLinePadded, totalFiles, srcPrefix, fromPath, dstPrefix, toPath)
+		}(srcClient, dstClient, srcPrefix, dstPrefix, currentLinePadded, totalFiles, ftp)
 	}
 	bwg.Wait()
 	if len(errc) != 0 {
@@ -177,34 +456,100 @@ func PerformCopy(srcClient, dstClient interface{}, srcPrefix, dstPrefix string,
 	return nil
 }
 
+// transfer copies a single file from srcPath to dstPath through an in memory buffer.
+// Data already streamed can not be read twice, so a failed copy is retried by downloading the whole file again.
+// attrs are applied to the copied file if they are not nil, and the copied data is written to sum if it is not nil
+func transfer(srcClient, dstClient interface{}, srcPrefix, fromPath, dstPrefix, toPath string, size int64, attrs *FileAttrs, journal *Journal, sum hash.Hash, opts CopyOptions) error {
+	// Each attempt streams the whole file, so the download and upload don't retry on their own
+	once := utils.RetryPolicy{MaxAttempts: 1}
+
+	return opts.Retry.Do(func(attempt int) error {
+		if attempt > 1 && opts.Verbose {
+			log.Printf("Attempt %d to copy %s://%s -> %s://%s", attempt, srcPrefix, fromPath, dstPrefix, toPath)
+		}
+
+		newBufferSize := (int64)(opts.BufferSize * 1024 * 1024) // may not be super accurate
+		buf := buffer.New(newBufferSize)
+		pr, pw := nio.Pipe(buf)
+
+		var w io.Writer = pw
+		if sum != nil {
+			sum.Reset()
+			w = io.MultiWriter(pw, sum)
+		}
+
+		dErrc := make(chan error, 1)
+		go func() {
+			err := download(srcClient, srcPrefix, fromPath, w, once, opts.Verbose)
+			pw.CloseWithError(err)
+			dErrc <- err
+		}()
+
+		uErr := upload(dstClient, dstPrefix, toPath, fromPath, pr, size, attrs, opts.S3PartSize, opts.S3MaxUploadParts, journal, once, opts.Verbose)
+		pr.Close()
+		dErr := <-dErrc
+
+		// A failed download fails the upload as well, and a failed upload fails the download
+		switch {
+		case utils.IsPermanent(dErr) || (dErr != nil && uErr == nil):
+			log.Println(dErr, fmt.Sprintf(" src: file: %s", fromPath))
+			return reopenRetryable(dErr)
+		case uErr != nil:
+			log.Println(uErr, fmt.Sprintf(" dst: file: %s", toPath))
+			return reopenRetryable(uErr)
+		}
+		return nil
+	})
+}
+
 // GetListOfFiles gets relative paths from the provided path
 func GetListOfFiles(client interface{}, prefix, path string) ([]string, error) {
+	files, err := getListOfFiles(client, prefix, path, listOptions{}, utils.DefaultRetryPolicy())
+	return relativePaths(files), err
+}
+
+// relativePaths returns the relative paths of files
+func relativePaths(files []FileInfo) []string {
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, f.RelativePath)
+	}
+	return paths
+}
+
+func getListOfFiles(client interface{}, prefix, path string, lo listOptions, retry utils.RetryPolicy) ([]FileInfo, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	var relativePaths []string
+	var relativePaths []FileInfo
 
 	switch prefix {
 	case "k8s":
-		paths, err := GetListOfFilesFromK8s(client, path, "f", "*")
+		paths, err := getListOfFilesFromK8s(client, path, "f", "*", lo, retry)
+		if err != nil {
+			return nil, err
+		}
+		relativePaths = paths
+	case "pvc":
+		paths, err := getListOfFilesFromPVC(client, path, "f", "*", lo, retry)
 		if err != nil {
 			return nil, err
 		}
 		relativePaths = paths
 	case "s3":
-		paths, err := GetListOfFilesFromS3(client, path)
+		paths, err := getListOfFilesFromS3(client, path)
 		if err != nil {
 			return nil, err
 		}
 		relativePaths = paths
 	case "abs":
-		paths, err := GetListOfFilesFromAbs(ctx, client, path)
+		paths, err := getListOfFilesFromAbs(ctx, client, path)
 		if err != nil {
 			return nil, err
 		}
 		relativePaths = paths
 	default:
-		return nil, fmt.Errorf(prefix + " not implemented")
+		return nil, fmt.Errorf("%s not implemented", prefix)
 	}
 
 	return relativePaths, nil
@@ -212,27 +557,36 @@ func GetListOfFiles(client interface{}, prefix, path string) ([]string, error) {
 
 // Download downloads a single file from path into an io.Writer
 func Download(srcClient interface{}, srcPrefix, srcPath string, writer io.Writer, verbose bool) error {
+	return download(srcClient, srcPrefix, srcPath, writer, utils.DefaultRetryPolicy(), verbose)
+}
+
+func download(srcClient interface{}, srcPrefix, srcPath string, writer io.Writer, retry utils.RetryPolicy, verbose bool) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	switch srcPrefix {
 	case "k8s":
-		err := DownloadFromK8s(srcClient, srcPath, writer, verbose)
+		err := downloadFromK8s(srcClient, srcPath, writer, retry, verbose)
+		if err != nil {
+			return err
+		}
+	case "pvc":
+		err := downloadFromPVC(srcClient, srcPath, writer, retry, verbose)
 		if err != nil {
 			return err
 		}
 	case "s3":
-		err := DownloadFromS3(srcClient, srcPath, writer, verbose)
+		err := downloadFromS3(srcClient, srcPath, writer, retry, verbose)
 		if err != nil {
 			return err
 		}
 	case "abs":
 		err := DownloadFromAbs(ctx, srcClient, srcPath, writer, verbose)
 		if err != nil {
-			return err
+			return absRetryable(err)
 		}
 	default:
-		return fmt.Errorf(srcPrefix + " not implemented")
+		return fmt.Errorf("%s not implemented", srcPrefix)
 	}
 
 	return nil
@@ -240,40 +594,49 @@ func Download(srcClient interface{}, srcPrefix, srcPath string, writer io.Writer
 
 // Upload uploads a single file provided as an io.Reader array to path
 func Upload(dstClient interface{}, dstPrefix, dstPath, srcPath string, reader io.Reader, s3partSize int64, s3maxUploadParts int, verbose bool) error {
+	return upload(dstClient, dstPrefix, dstPath, srcPath, reader, -1, nil, s3partSize, s3maxUploadParts, nil, utils.DefaultRetryPolicy(), verbose)
+}
+
+func upload(dstClient interface{}, dstPrefix, dstPath, srcPath string, reader io.Reader, size int64, attrs *FileAttrs, s3partSize int64, s3maxUploadParts int, journal *Journal, retry utils.RetryPolicy, verbose bool) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	switch dstPrefix {
 	case "k8s":
-		err := UploadToK8s(dstClient, dstPath, srcPath, reader, verbose)
+		err := uploadToK8s(dstClient, dstPath, srcPath, reader, attrs, retry, verbose)
+		if err != nil {
+			return err
+		}
+	case "pvc":
+		err := uploadToPVC(dstClient, dstPath, srcPath, reader, attrs, retry, verbose)
 		if err != nil {
 			return err
 		}
 	case "s3":
-		err := UploadToS3(dstClient, dstPath, srcPath, reader, s3partSize, s3maxUploadParts, verbose)
+		err := uploadToS3(dstClient, dstPath, srcPath, reader, size, attrs, s3partSize, s3maxUploadParts, journal, retry, verbose)
 		if err != nil {
 			return err
 		}
 	case "abs":
-		err := UploadToAbs(ctx, dstClient, dstPath, srcPath, reader, verbose)
+		err := uploadToAbs(ctx, dstClient, dstPath, srcPath, reader, size, attrs, journal, retry, verbose)
 		if err != nil {
-			return err
+			return absRetryable(err)
 		}
 	default:
-		return fmt.Errorf(dstPrefix + " not implemented")
+		return fmt.Errorf("%s not implemented", dstPrefix)
 	}
 	return nil
 }
 
-func initClient(ctx context.Context, existingClient interface{}, prefix, path, tested string) (interface{}, string, error) {
+func initClient(ctx context.Context, existingClient interface{}, prefix, path, tested string, k8sOpts K8sClientOptions, retry utils.RetryPolicy) (interface{}, string, error) {
 	var newClient interface{}
 	switch prefix {
-	case "k8s":
+	case "k8s", "pvc":
 		if isTestedAndClientExists(prefix, tested, existingClient) {
 			newClient = existingClient
 			break
 		}
-		client, err := GetClientToK8s()
+		client, err := GetClientToK8sWithOptions(k8sOpts)
 		if err != nil {
 			return nil, "", err
 		}
@@ -284,7 +647,7 @@ func initClient(ctx context.Context, existingClient interface{}, prefix, path, t
 			newClient = existingClient
 			break
 		}
-		client, err := GetClientToS3(path)
+		client, err := getClientToS3(path, retry)
 		if err != nil {
 			return nil, "", err
 		}
@@ -295,14 +658,14 @@ func initClient(ctx context.Context, existingClient interface{}, prefix, path, t
 			newClient = existingClient
 			break
 		}
-		client, err := GetClientToAbs(ctx, path)
+		client, err := getClientToAbs(ctx, path, retry)
 		if err != nil {
 			return nil, "", err
 		}
 		newClient = client
 
 	default:
-		return nil, "", fmt.Errorf(prefix + " not implemented")
+		return nil, "", fmt.Errorf("%s not implemented", prefix)
 	}
 
 	return newClient, prefix, nil
@@ -0,0 +1,184 @@
+package skbn
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	core_v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// A snapshot copy reads a pvc:// source from a CSI volume snapshot of the claim instead of the claim itself,
+// so the copy is consistent to the point in time of the snapshot. The snapshot is restored into a temporary claim,
+// which is mounted by the helper pod. The snapshot and the temporary claim are deleted when the client is closed
+
+const (
+	snapshotTimeout = 10 * time.Minute
+)
+
+var volumeSnapshotResource = schema.GroupVersionResource{
+	Group:    "snapshot.storage.k8s.io",
+	Version:  "v1",
+	Resource: "volumesnapshots",
+}
+
+// SnapshotOptions configures copying persistent volume claim sources from volume snapshots
+type SnapshotOptions struct {
+	Enabled bool   // copy pvc:// sources from a volume snapshot
+	Class   string // volume snapshot class, empty for the default class
+}
+
+type restoredClaim struct {
+	namespace string
+	snapshot  string
+	claim     string
+}
+
+// restoreSnapshot takes a volume snapshot of a claim, restores it into a new claim and returns the name of the new claim
+func (client K8sClient) restoreSnapshot(namespace, claim string) (string, error) {
+	source, err := client.ClientSet.CoreV1().PersistentVolumeClaims(namespace).Get(context.Background(), claim, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("error getting persistent volume claim %s/%s: %v", namespace, claim, err)
+	}
+	snapshots, err := client.volumeSnapshots(namespace)
+	if err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("skbn-%x", rand.Uint32())
+	snapshotSpec := map[string]interface{}{
+		"source": map[string]interface{}{"persistentVolumeClaimName": claim},
+	}
+	if client.Snapshot.Class != "" {
+		snapshotSpec["volumeSnapshotClassName"] = client.Snapshot.Class
+	}
+	snapshot := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": volumeSnapshotResource.GroupVersion().String(),
+		"kind":       "VolumeSnapshot",
+		"metadata": map[string]interface{}{
+			"name":        name,
+			"labels":      map[string]interface{}{"app": "skbn", "skbn/helper": "snapshot"},
+			"annotations": map[string]interface{}{"skbn/claim": claim},
+		},
+		"spec": snapshotSpec,
+	}}
+	if _, err := snapshots.Create(context.Background(), snapshot, metav1.CreateOptions{}); err != nil {
+		return "", fmt.Errorf("error creating volume snapshot of %s/%s: %v", namespace, claim, err)
+	}
+	client.helpers.mu.Lock()
+	i := len(client.helpers.restored)
+	client.helpers.restored = append(client.helpers.restored, restoredClaim{namespace: namespace, snapshot: name})
+	client.helpers.mu.Unlock()
+
+	restoreSize, err := waitForSnapshot(snapshots, name)
+	if err != nil {
+		return "", fmt.Errorf("volume snapshot %s/%s of %s: %v", namespace, name, claim, err)
+	}
+
+	size := source.Spec.Resources.Requests[core_v1.ResourceStorage]
+	if restoreSize != nil && restoreSize.Cmp(size) > 0 {
+		size = *restoreSize
+	}
+	apiGroup := volumeSnapshotResource.Group
+	pvc := &core_v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Labels:      map[string]string{"app": "skbn", "skbn/helper": "snapshot"},
+			Annotations: map[string]string{"skbn/claim": claim},
+		},
+		Spec: core_v1.PersistentVolumeClaimSpec{
+			AccessModes:      source.Spec.AccessModes,
+			StorageClassName: source.Spec.StorageClassName,
+			VolumeMode:       source.Spec.VolumeMode,
+			Resources: core_v1.VolumeResourceRequirements{
+				Requests: core_v1.ResourceList{core_v1.ResourceStorage: size},
+			},
+			DataSource: &core_v1.TypedLocalObjectReference{
+				APIGroup: &apiGroup,
+				Kind:     "VolumeSnapshot",
+				Name:     name,
+			},
+		},
+	}
+	if _, err := client.ClientSet.CoreV1().PersistentVolumeClaims(namespace).Create(context.Background(), pvc, metav1.CreateOptions{}); err != nil {
+		return "", fmt.Errorf("error restoring volume snapshot %s/%s: %v", namespace, name, err)
+	}
+	client.helpers.mu.Lock()
+	client.helpers.restored[i].claim = name
+	client.helpers.mu.Unlock()
+
+	return name, nil
+}
+
+// deleteSnapshots deletes all the restored claims and volume snapshots created by the client.
+// Helper pods mounting the restored claims should be deleted first
+func (client K8sClient) deleteSnapshots() error {
+	if client.helpers == nil {
+		return nil
+	}
+	client.helpers.mu.Lock()
+	defer client.helpers.mu.Unlock()
+
+	var lastErr error
+	for _, r := range client.helpers.restored {
+		if r.claim != "" {
+			if err := client.ClientSet.CoreV1().PersistentVolumeClaims(r.namespace).Delete(context.Background(), r.claim, metav1.DeleteOptions{}); err != nil {
+				lastErr = fmt.Errorf("error deleting persistent volume claim %s/%s: %v", r.namespace, r.claim, err)
+			}
+		}
+		snapshots, err := client.volumeSnapshots(r.namespace)
+		if err == nil {
+			err = snapshots.Delete(context.Background(), r.snapshot, metav1.DeleteOptions{})
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("error deleting volume snapshot %s/%s: %v", r.namespace, r.snapshot, err)
+		}
+	}
+	client.helpers.restored = nil
+
+	return lastErr
+}
+
+func (client K8sClient) volumeSnapshots(namespace string) (dynamic.ResourceInterface, error) {
+	dynamicClient, err := dynamic.NewForConfig(client.Config)
+	if err != nil {
+		return nil, err
+	}
+	return dynamicClient.Resource(volumeSnapshotResource).Namespace(namespace), nil
+}
+
+// waitForSnapshot waits for a volume snapshot to be ready to use, and returns its restore size if it is known
+func waitForSnapshot(snapshots dynamic.ResourceInterface, name string) (*resource.Quantity, error) {
+	deadline := time.Now().Add(snapshotTimeout)
+	for time.Now().Before(deadline) {
+		snapshot, err := snapshots.Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+
+		if message, found, _ := unstructured.NestedString(snapshot.Object, "status", "error", "message"); found {
+			return nil, fmt.Errorf("snapshot failed: %s", message)
+		}
+		if ready, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse"); ready {
+			restoreSize, found, _ := unstructured.NestedString(snapshot.Object, "status", "restoreSize")
+			if !found {
+				return nil, nil
+			}
+			q, err := resource.ParseQuantity(restoreSize)
+			if err != nil {
+				return nil, nil
+			}
+			return &q, nil
+		}
+
+		time.Sleep(time.Second)
+	}
+
+	return nil, fmt.Errorf("timed out waiting for the snapshot to be ready")
+}
@@ -0,0 +1,333 @@
+package skbn
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/nuvo/skbn/pkg/utils"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Besides regular files, symbolic links and empty directories can be copied.
+// In S3 and Azure Blob Storage, a symbolic link is an empty object with the link's target in its metadata,
+// and an empty directory is an empty object named after the directory with a trailing slash
+
+const (
+	// SymlinksSkip skips symbolic links
+	SymlinksSkip = "skip"
+	// SymlinksFollow copies the files symbolic links point to
+	SymlinksFollow = "follow"
+	// SymlinksCopy copies symbolic links as symbolic links
+	SymlinksCopy = "copy"
+
+	linkMetadata = "skbnlink"
+
+	// readlinkBatch is the number of links read by a single command
+	readlinkBatch = 200
+)
+
+// listOptions selects the entries listed besides regular files
+type listOptions struct {
+	symlinks  string // SymlinksSkip (default), SymlinksFollow or SymlinksCopy
+	emptyDirs bool   // list empty directories
+	readWrite bool   // list a pvc path in the read-write helper pod, which then changes the listed files
+}
+
+// listOptions returns the list options of a copy
+func (opts CopyOptions) listOptions() listOptions {
+	return listOptions{symlinks: opts.Symlinks, emptyDirs: opts.EmptyDirs}
+}
+
+// ValidateSymlinks returns an error if policy is not a known symbolic links policy
+func ValidateSymlinks(policy string) error {
+	switch policy {
+	case "", SymlinksSkip, SymlinksFollow, SymlinksCopy:
+		return nil
+	}
+	return fmt.Errorf("illegal symbolic links policy: %s", policy)
+}
+
+// File types in the mode printed by stat -c %f
+const (
+	modeTypeMask    = 0170000
+	modeTypeRegular = 0100000
+	modeTypeDir     = 0040000
+	modeTypeLink    = 0120000
+)
+
+var findTypes = map[string]uint32{
+	"f": modeTypeRegular,
+	"d": modeTypeDir,
+	"l": modeTypeLink,
+	"s": 0140000,
+	"p": 0010000,
+	"c": 0020000,
+	"b": 0060000,
+}
+
+// k8sEntry is an entry listed in a container
+type k8sEntry struct {
+	mode uint32
+	path string // full path in the container
+	info FileInfo
+}
+
+// k8sLink is a symbolic link listed in a container, of which the target is still to be read
+type k8sLink struct {
+	index int // index of the link in the listed files
+	path  string
+}
+
+// selectK8sEntries returns the listed entries of type findType.
+// For regular files, symbolic links and empty directories are selected as well according to lo,
+// and the entries that are not copied are reported. Links are returned with the files, their targets are still to be read
+func selectK8sEntries(entries []k8sEntry, findType string, lo listOptions, location string) ([]FileInfo, []k8sLink) {
+	var files []FileInfo
+	if findType != "f" {
+		for _, e := range entries {
+			if e.mode&modeTypeMask == findTypes[findType] {
+				files = append(files, e.info)
+			}
+		}
+		return files, nil
+	}
+
+	var links []k8sLink
+	var dirs []FileInfo
+	hasChildren := make(map[string]bool)
+	for _, e := range entries {
+		rel := e.info.RelativePath
+		switch e.mode & modeTypeMask {
+		case modeTypeRegular:
+			files = append(files, e.info)
+		case modeTypeDir:
+			dirs = append(dirs, e.info)
+		case modeTypeLink:
+			if lo.symlinks != SymlinksCopy {
+				log.Printf("skipping symbolic link %s:%s", location, e.path)
+				continue
+			}
+			links = append(links, k8sLink{index: len(files), path: e.path})
+			e.info.Attrs = nil
+			files = append(files, e.info)
+		default:
+			log.Printf("skipping special file %s:%s", location, e.path)
+			continue
+		}
+		if rel != "" {
+			hasChildren[path.Dir(rel)] = true
+		}
+	}
+
+	if lo.emptyDirs {
+		for _, d := range dirs {
+			key := d.RelativePath
+			if key == "" {
+				key = "/"
+			}
+			if !hasChildren[key] {
+				d.IsDir = true
+				d.Size = 0
+				files = append(files, d)
+			}
+		}
+	}
+
+	return files, links
+}
+
+// readK8sLinks reads the targets of links in a container into files
+func readK8sLinks(client K8sClient, namespace, podName, containerName string, files []FileInfo, links []k8sLink, retry utils.RetryPolicy) error {
+	for start := 0; start < len(links); start += readlinkBatch {
+		end := start + readlinkBatch
+		if end > len(links) {
+			end = len(links)
+		}
+		batch := links[start:end]
+
+		// Command substitution strips trailing newlines, so a dot is appended to keep those of the target
+		command := []string{"sh", "-c", `for f; do t=$(readlink "$f"; echo .); t=${t%.}; printf "%s\0" "${t%?}"; done`, "sh"}
+		for _, l := range batch {
+			command = append(command, l.path)
+		}
+
+		err := retry.Do(func(attempt int) error {
+			output := new(bytes.Buffer)
+			stderr, err := Exec(client, namespace, podName, containerName, command, nil, output)
+			if len(stderr) != 0 {
+				return k8sStderrError(stderr)
+			}
+			if err != nil {
+				return k8sRetryable(err)
+			}
+
+			targets, err := parseK8sLinkTargets(output.String(), len(batch))
+			if err != nil {
+				return utils.Permanent(err)
+			}
+			for i, l := range batch {
+				files[l.index].LinkTarget = targets[i]
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseK8sLinkTargets parses the NUL terminated targets of count links
+func parseK8sLinkTargets(output string, count int) ([]string, error) {
+	if !strings.HasSuffix(output, "\x00") {
+		return nil, fmt.Errorf("unexpected output from readlink: %q", output)
+	}
+	targets := strings.Split(strings.TrimSuffix(output, "\x00"), "\x00")
+	if len(targets) != count {
+		return nil, fmt.Errorf("unexpected output from readlink: %q", output)
+	}
+	return targets, nil
+}
+
+// createSpecial creates the empty directory or the symbolic link of ftp in toPath
+func createSpecial(dstClient interface{}, dstPrefix, toPath string, ftp FromToPair, attrs *FileAttrs, retry utils.RetryPolicy) error {
+	switch dstPrefix {
+	case "k8s":
+		return createInK8s(dstClient, toPath, ftp, attrs, retry)
+	case "pvc":
+		client, k8sPath, err := pvcToK8sPath(dstClient, toPath, false)
+		if err != nil {
+			return err
+		}
+		return createInK8s(client, k8sPath, ftp, attrs, retry)
+	case "s3":
+		return createInS3(dstClient, toPath, ftp, attrs, retry)
+	case "abs":
+		return createInAbs(dstClient, toPath, ftp, attrs)
+	default:
+		return fmt.Errorf("%s not implemented", dstPrefix)
+	}
+}
+
+func createInK8s(iClient interface{}, toPath string, ftp FromToPair, attrs *FileAttrs, retry utils.RetryPolicy) error {
+	client := *iClient.(*K8sClient)
+	pSplit := strings.Split(toPath, "/")
+	if err := validateK8sPath(pSplit); err != nil {
+		return err
+	}
+	namespace, podName, containerName, pathToCreate := initK8sVariables(pSplit)
+	execContainer, root, err := client.execTarget(namespace, podName, containerName)
+	if err != nil {
+		return err
+	}
+
+	commands := [][]string{{"mkdir", "-p", root + pathToCreate}}
+	if !ftp.IsDir {
+		commands = [][]string{
+			{"mkdir", "-p", path.Dir(root + pathToCreate)},
+			{"ln", "-sfn", ftp.LinkTarget, root + pathToCreate},
+		}
+	} else if attrs != nil {
+		commands = append(commands, k8sAttrsCommand(root+pathToCreate, attrs))
+	}
+
+	return retry.Do(func(attempt int) error {
+		for _, command := range commands {
+			stderr, err := Exec(client, namespace, podName, execContainer, command, nil, nil)
+			if err != nil {
+				if len(stderr) != 0 {
+					return k8sStderrError(stderr)
+				}
+				return k8sRetryable(err)
+			}
+			if len(stderr) != 0 {
+				log.Printf("Warning: %s/%s/%s:%s: %s", namespace, podName, containerName, pathToCreate, strings.TrimSpace(string(stderr)))
+			}
+		}
+		return nil
+	})
+}
+
+func createInS3(iClient interface{}, toPath string, ftp FromToPair, attrs *FileAttrs, retry utils.RetryPolicy) error {
+	s := iClient.(*session.Session)
+	pSplit := strings.Split(toPath, "/")
+	if err := validateS3Path(pSplit); err != nil {
+		return err
+	}
+	bucket, key := initS3Variables(pSplit)
+	if ftp.IsDir {
+		key += "/"
+	}
+
+	return retry.Do(func(attempt int) error {
+		_, err := s3.New(s).PutObject(&s3.PutObjectInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(key),
+			Body:     bytes.NewReader(nil),
+			Metadata: aws.StringMap(specialMetadata(ftp, attrs)),
+		})
+		return s3Retryable(err)
+	})
+}
+
+// createInAbs creates an empty blob. Requests are retried by the pipeline of the client
+func createInAbs(iClient interface{}, toPath string, ftp FromToPair, attrs *FileAttrs) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pSplit := strings.Split(toPath, "/")
+	if err := validateAbsPath(pSplit); err != nil {
+		return err
+	}
+	a, c, p := initAbsVariables(pSplit)
+	cu, err := getContainerURL(iClient.(pipeline.Pipeline), a, c)
+	if err != nil {
+		return err
+	}
+	if ftp.IsDir {
+		p += "/"
+	}
+
+	_, err = getBlobURL(cu, p).Upload(ctx, bytes.NewReader(nil), azblob.BlobHTTPHeaders{}, azblob.Metadata(specialMetadata(ftp, attrs)),
+		azblob.BlobAccessConditions{}, azblob.DefaultAccessTier, nil, azblob.ClientProvidedKeyOptions{}, azblob.ImmutabilityPolicyOptions{})
+	return err
+}
+
+// specialMetadata returns the object metadata of an empty directory or a symbolic link
+func specialMetadata(ftp FromToPair, attrs *FileAttrs) map[string]string {
+	metadata := attrs.metadata()
+	if ftp.LinkTarget == "" {
+		return metadata
+	}
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+	// Metadata values are sent as HTTP headers, which can not hold every byte of a target
+	metadata[linkMetadata] = url.PathEscape(ftp.LinkTarget)
+	return metadata
+}
+
+// linkFromMetadata returns the target of a symbolic link stored in object metadata, or an empty string.
+// A target which is not percent encoded is returned as is
+func linkFromMetadata(metadata map[string]string) string {
+	for k, v := range metadata {
+		if strings.EqualFold(k, linkMetadata) {
+			if target, err := url.PathUnescape(v); err == nil {
+				return target
+			}
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,28 @@
+package skbn
+
+import (
+	"testing"
+)
+
+func TestLinkMetadata(t *testing.T) {
+	for _, target := range []string{"target", "../dir/file", "a b\nc\t%d", "-dash", "bad\xff\xfe", "ü"} {
+		metadata := specialMetadata(FromToPair{LinkTarget: target}, nil)
+		for _, c := range metadata[linkMetadata] {
+			if c < 0x21 || c > 0x7e {
+				t.Errorf("%q: metadata %q holds %q", target, metadata[linkMetadata], c)
+				break
+			}
+		}
+		if got := linkFromMetadata(map[string]string{"Skbnlink": metadata[linkMetadata]}); got != target {
+			t.Errorf("got target %q, want %q", got, target)
+		}
+	}
+
+	// Targets stored before they were encoded
+	if got := linkFromMetadata(map[string]string{linkMetadata: "100% done"}); got != "100% done" {
+		t.Errorf("got target %q, want 100%% done", got)
+	}
+	if got := linkFromMetadata(map[string]string{"other": "x"}); got != "" {
+		t.Errorf("got target %q, want none", got)
+	}
+}
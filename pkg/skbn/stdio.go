@@ -0,0 +1,75 @@
+package skbn
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// StdioPath is a source (or destination) path meaning stdin (or stdout)
+const StdioPath = "-"
+
+// CopyFromReader uploads the data read from reader to a single file at dst.
+// The size of the data is unknown, so uploads to S3 grow their part size as they go.
+// Data already read can not be read twice, so a failed upload is retried only if nothing was read yet
+func CopyFromReader(reader io.Reader, dst string, opts CopyOptions) error {
+	if err := validateStdioCopy(opts); err != nil {
+		return err
+	}
+	client, prefix, path, err := openPath(dst, opts.DstK8s, opts.Retry)
+	if err != nil {
+		return err
+	}
+	defer closeClients(client)
+
+	if opts.Verbose {
+		log.Printf("copy: stdin -> %s://%s", prefix, path)
+	}
+	return upload(client, prefix, path, StdioPath, reader, -1, nil, opts.S3PartSize, opts.S3MaxUploadParts, nil, opts.Retry, opts.Verbose)
+}
+
+// CopyToWriter downloads a single file at src into writer.
+// Data already written can not be taken back, so a failed download is retried only if nothing was written yet
+func CopyToWriter(src string, writer io.Writer, opts CopyOptions) error {
+	if err := validateStdioCopy(opts); err != nil {
+		return err
+	}
+	client, prefix, path, err := openPath(src, opts.SrcK8s, opts.Retry)
+	if err != nil {
+		return err
+	}
+	defer closeClients(client)
+
+	if opts.Verbose {
+		log.Printf("copy: %s://%s -> stdout", prefix, path)
+	}
+	return download(client, prefix, path, writer, opts.Retry, opts.Verbose)
+}
+
+// copyStdio copies from stdin to dst, or from src to stdout
+func copyStdio(src, dst string, opts CopyOptions) error {
+	switch {
+	case src == StdioPath && dst == StdioPath:
+		return fmt.Errorf("can not copy from stdin to stdout")
+	case src == StdioPath:
+		return CopyFromReader(os.Stdin, dst, opts)
+	default:
+		return CopyToWriter(src, os.Stdout, opts)
+	}
+}
+
+// validateStdioCopy returns an error if an option does not apply to a copy from stdin or to stdout
+func validateStdioCopy(opts CopyOptions) error {
+	switch {
+	case opts.JournalPath != "":
+		return fmt.Errorf("a copy from stdin or to stdout can not be journaled")
+	case opts.FanOut:
+		return fmt.Errorf("a copy from stdin or to stdout can not fan out")
+	case opts.Move:
+		return fmt.Errorf("can not move from stdin or to stdout")
+	case opts.PreHook != "" || opts.PostHook != "":
+		return fmt.Errorf("hooks can not run in a copy from stdin or to stdout")
+	}
+	return nil
+}
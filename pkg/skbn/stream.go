@@ -0,0 +1,68 @@
+package skbn
+
+import (
+	"errors"
+	"io"
+
+	"github.com/nuvo/skbn/pkg/utils"
+)
+
+// countingReader counts the bytes read from a reader, and records the first error of the reader.
+// Some transports end the input of a command at any read error as if it was complete, so the error is checked after the command
+type countingReader struct {
+	reader io.Reader
+	n      int64
+	err    error // the first error other than io.EOF
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n += int64(n)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// countingWriter counts the bytes written to a writer
+type countingWriter struct {
+	writer io.Writer
+	n      int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// streamError is an error which happened after data was already read from a reader (or written to a writer).
+// Retrying with the same reader would transfer a truncated file, so only a caller that can reopen the stream may retry
+type streamError struct {
+	err error
+}
+
+func (e *streamError) Error() string {
+	return e.err.Error()
+}
+
+func (e *streamError) Unwrap() error {
+	return e.err
+}
+
+// streamRetryable stops the retries of an operation that already transferred n bytes of a stream
+func streamRetryable(err error, n int64) error {
+	if err == nil || n == 0 || utils.IsPermanent(err) {
+		return err
+	}
+	return utils.Permanent(&streamError{err: err})
+}
+
+// reopenRetryable returns the error inside a streamError, so it can be retried by reopening the stream
+func reopenRetryable(err error) error {
+	var se *streamError
+	if errors.As(err, &se) {
+		return se.err
+	}
+	return err
+}
@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy describes how a failed operation is retried
+type RetryPolicy struct {
+	MaxAttempts    int           // number of attempts, including the first one. 0 for the default, 1 for no retries
+	InitialBackoff time.Duration // backoff before the second attempt, doubled for each following attempt
+	MaxBackoff     time.Duration // maximal backoff between attempts
+	MaxElapsedTime time.Duration // stop retrying once this much time has passed since the first attempt, 0 for no limit
+}
+
+// DefaultRetryPolicy returns the retry policy used when none is provided
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 1 * time.Second,
+		MaxBackoff:     30 * time.Second,
+	}
+}
+
+// WithDefaults returns the policy with unset fields taken from DefaultRetryPolicy
+func (p RetryPolicy) WithDefaults() RetryPolicy {
+	d := DefaultRetryPolicy()
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = d.MaxAttempts
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = d.InitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = d.MaxBackoff
+	}
+	if p.MaxBackoff < p.InitialBackoff {
+		p.MaxBackoff = p.InitialBackoff
+	}
+	return p
+}
+
+// Backoff returns the time to wait after a failed attempt (starting at 1).
+// The backoff grows exponentially, and half of it is randomized to spread retries of parallel operations
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	p = p.WithDefaults()
+	backoff := p.InitialBackoff
+	for i := 1; i < attempt && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	half := int64(backoff / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// Do calls fn until it succeeds, returns a permanent error or the policy is exhausted.
+// fn receives the number of the current attempt (starting at 1). The last error is returned,
+// still marked as permanent if it was, so retries around Do don't retry it either
+func (p RetryPolicy) Do(fn func(attempt int) error) error {
+	p = p.WithDefaults()
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := fn(attempt)
+		if err == nil {
+			return nil
+		}
+		if IsPermanent(err) {
+			return err
+		}
+		if attempt >= p.MaxAttempts {
+			return err
+		}
+		backoff := p.Backoff(attempt)
+		if p.MaxElapsedTime > 0 && time.Since(start)+backoff > p.MaxElapsedTime {
+			return err
+		}
+		time.Sleep(backoff)
+	}
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks err as an error that should not be retried
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent returns true if err was marked as an error that should not be retried
+func IsPermanent(err error) bool {
+	var perm *permanentError
+	return errors.As(err, &perm)
+}
@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDo(t *testing.T) {
+	errFail := errors.New("fail")
+	fast := RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+	withAttempts := func(n int) RetryPolicy {
+		p := fast
+		p.MaxAttempts = n
+		return p
+	}
+	tests := []struct {
+		name      string
+		policy    RetryPolicy
+		failures  int   // attempts failing before one succeeds
+		err       error // error of failing attempts
+		attempts  int
+		wantErr   bool
+		permanent bool
+	}{
+		{"success", withAttempts(3), 0, errFail, 1, false, false},
+		{"success after retries", withAttempts(3), 2, errFail, 3, false, false},
+		{"attempts exhausted", withAttempts(3), 10, errFail, 3, true, false},
+		{"no retries", withAttempts(1), 10, errFail, 1, true, false},
+		{"default attempts", withAttempts(0), 10, errFail, 3, true, false},
+		{"negative attempts", withAttempts(-1), 10, errFail, 3, true, false},
+		{"permanent error", withAttempts(5), 10, Permanent(errFail), 1, true, true},
+	}
+	for _, tt := range tests {
+		attempts := 0
+		err := tt.policy.Do(func(attempt int) error {
+			attempts++
+			if attempt != attempts {
+				t.Errorf("%s: got attempt %d, want %d", tt.name, attempt, attempts)
+			}
+			if attempts <= tt.failures {
+				return tt.err
+			}
+			return nil
+		})
+		if attempts != tt.attempts {
+			t.Errorf("%s: got %d attempts, want %d", tt.name, attempts, tt.attempts)
+		}
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want an error: %v", tt.name, err, tt.wantErr)
+		}
+		if tt.wantErr && !errors.Is(err, errFail) {
+			t.Errorf("%s: got error %v, want the error of the last attempt", tt.name, err)
+		}
+		if IsPermanent(err) != tt.permanent {
+			t.Errorf("%s: got permanent %v, want %v", tt.name, IsPermanent(err), tt.permanent)
+		}
+	}
+}
+
+func TestRetryPolicyDoMaxElapsedTime(t *testing.T) {
+	p := RetryPolicy{
+		MaxAttempts:    100,
+		InitialBackoff: 20 * time.Millisecond,
+		MaxBackoff:     20 * time.Millisecond,
+		MaxElapsedTime: 100 * time.Millisecond,
+	}
+	attempts := 0
+	start := time.Now()
+	err := p.Do(func(attempt int) error {
+		attempts++
+		return errors.New("fail")
+	})
+	elapsed := time.Since(start)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	// Backoffs of 10 to 20ms fit 5 to 10 retries in 100ms, and no backoff goes past the limit
+	if attempts < 5 || attempts > 11 {
+		t.Errorf("got %d attempts, want 5 to 11", attempts)
+	}
+	if elapsed > p.MaxElapsedTime+50*time.Millisecond {
+		t.Errorf("retried for %v, want about %v", elapsed, p.MaxElapsedTime)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{50, time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			if b := p.Backoff(tt.attempt); b < tt.max/2 || b > tt.max {
+				t.Errorf("attempt %d: got backoff %v, want %v to %v", tt.attempt, b, tt.max/2, tt.max)
+			}
+		}
+	}
+}
+
+func TestRetryPolicyWithDefaults(t *testing.T) {
+	d := DefaultRetryPolicy()
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+		want   RetryPolicy
+	}{
+		{"zero", RetryPolicy{}, d},
+		{"set", RetryPolicy{MaxAttempts: 1, InitialBackoff: time.Second, MaxBackoff: time.Minute, MaxElapsedTime: time.Hour},
+			RetryPolicy{MaxAttempts: 1, InitialBackoff: time.Second, MaxBackoff: time.Minute, MaxElapsedTime: time.Hour}},
+		{"max backoff below initial backoff", RetryPolicy{InitialBackoff: time.Minute, MaxBackoff: time.Second},
+			RetryPolicy{MaxAttempts: d.MaxAttempts, InitialBackoff: time.Minute, MaxBackoff: time.Minute}},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.WithDefaults(); got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPermanent(t *testing.T) {
+	if Permanent(nil) != nil {
+		t.Error("Permanent(nil) is not nil")
+	}
+	errFail := errors.New("fail")
+	err := Permanent(errFail)
+	if !IsPermanent(err) || !errors.Is(err, errFail) || err.Error() != "fail" {
+		t.Errorf("got %v, want a permanent fail", err)
+	}
+	if IsPermanent(errFail) {
+		t.Error("an unmarked error is permanent")
+	}
+}
@@ -1,7 +1,9 @@
 package utils
 
 import (
+	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -28,10 +30,42 @@ func SplitInTwo(s, sep string) (string, string) {
 	if !strings.Contains(s, sep) {
 		log.Fatal(s, "does not contain", sep)
 	}
-	split := strings.Split(s, sep)
+	split := strings.SplitN(s, sep, 2)
 	return split[0], split[1]
 }
 
+// TrimPathPrefix returns name relative to the path prefix, with a leading slash,
+// if name is prefix or is under it. A prefix only matches whole path components
+func TrimPathPrefix(name, prefix string) (string, bool) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		if strings.HasPrefix(name, "/") {
+			return name, true
+		}
+		return "/" + name, true
+	}
+	if name == prefix {
+		return "", true
+	}
+	if strings.HasPrefix(name, prefix+"/") {
+		return name[len(prefix):], true
+	}
+	return "", false
+}
+
+// UnescapePath decodes the URL escaped (percent encoded) components of a path, such as %20 for a space
+func UnescapePath(path string) (string, error) {
+	split := strings.Split(path, "/")
+	for i, s := range split {
+		u, err := url.PathUnescape(s)
+		if err != nil {
+			return "", fmt.Errorf("illegal path %s, a literal %% must be escaped as %%25: %v", path, err)
+		}
+		split[i] = u
+	}
+	return strings.Join(split, "/"), nil
+}
+
 // CountDigits counts the digits of an integer
 func CountDigits(i int) (count int) {
 	for i != 0 {